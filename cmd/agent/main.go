@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"sync"
 
-	"github.com/fatih/structs"
 	"go.uber.org/zap"
 
 	"github.com/AlekseyKas/metrics/internal/agent/helpers"
+	"github.com/AlekseyKas/metrics/internal/agent/queue"
 	"github.com/AlekseyKas/metrics/internal/config"
+	"github.com/AlekseyKas/metrics/internal/crypto"
+	"github.com/AlekseyKas/metrics/internal/retry"
 	"github.com/AlekseyKas/metrics/internal/storage"
 )
 
@@ -35,28 +37,63 @@ func main() {
 		logger.Error("Error init logger: ", zap.Error(err))
 	}
 
-	// Init map of metrics.
-	var MapMetrics = structs.Map(storage.Metrics{})
-	s := &storage.MetricsStore{
-		MM: MapMetrics,
-	}
-	storageM = s
 	// Tegminate enviranment and flags.
 	config.TermEnvFlagsAgent()
 	// Init logger.
 	storage.InitLogger(logger)
 	// Init context with cancel.
 	ctx, cancel := context.WithCancel(context.Background())
+	// Init storage with known metrics.
+	storageM = storage.NewMetricsStore()
 	// Add count waitgroup.
 	wg.Add(4)
 	// Wait signal from operation system.
 	go helpers.WaitSignals(cancel, logger, wg)
 	// Update metrics terminating.
 	go helpers.UpdateMetrics(ctx, config.ArgsM.PollInterval, wg, logger, storageM)
-	// Update new metrics.
-	go helpers.UpdateMetricsNew(ctx, config.ArgsM.PollInterval, wg, logger, storageM)
+	// Update system metrics by collectors enabled in config.
+	collectors, err := helpers.ParseCollectors(config.ArgsM.Collectors)
+	if err != nil {
+		logger.Fatal("Error parsing collectors: ", zap.Error(err))
+	}
+	go helpers.UpdateMetricsNew(ctx, config.ArgsM.PollInterval, collectors, wg, logger, storageM)
+	// Load public key once, it is reloaded on SIGHUP.
+	var enc *crypto.Encrypter
+	if config.ArgsM.PubKey != "" {
+		enc, err = crypto.NewEncrypter(config.ArgsM.PubKey)
+		if err != nil {
+			logger.Fatal("Error loading public key: ", zap.Error(err))
+		}
+		go helpers.ReloadKeys(ctx, logger, enc)
+	}
+	// Load TLS config for https scheme.
+	switch config.ArgsM.Scheme {
+	case "", "http":
+	case "https":
+		cfg, err := crypto.ClientTLSConfig(config.ArgsM.TLSCA, config.ArgsM.TLSCert, config.ArgsM.TLSKey)
+		if err != nil {
+			logger.Fatal("Error loading TLS config: ", zap.Error(err))
+		}
+		helpers.SetTLSConfig(cfg)
+	default:
+		logger.Fatal("Unknown scheme: ", zap.String("scheme", config.ArgsM.Scheme))
+	}
+	// Retries of sending report.
+	policy, err := retry.NewPolicy(config.ArgsM.RetryAttempts, config.ArgsM.RetryBackoff)
+	if err != nil {
+		logger.Fatal("Error parsing retry policy: ", zap.Error(err))
+	}
+	helpers.SetRetry(policy)
+	// Open queue of undelivered batches.
+	if config.ArgsM.QueueDir != "" {
+		q, err := queue.Open(config.ArgsM.QueueDir, int64(config.ArgsM.QueueMaxSize), config.ArgsM.QueueMaxAge)
+		if err != nil {
+			logger.Fatal("Error opening queue: ", zap.Error(err))
+		}
+		helpers.SetQueue(q)
+	}
 	// Send metrics to server.
-	go helpers.SendMetrics(ctx, wg, logger, config.ArgsM.PubKey, storageM)
+	go helpers.SendMetrics(ctx, config.ArgsM.ReportInterval, wg, logger, enc, storageM)
 
 	// Printing build options.
 	fmt.Printf("Build version:%s \n", buildVersion)
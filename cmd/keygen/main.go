@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/AlekseyKas/metrics/internal/crypto"
+)
+
+func main() {
+	out := flag.String("o", "key", "Path of private key, public key is written to path.pub")
+	bits := flag.Int("b", 4096, "Size of RSA key in bits")
+	flag.Parse()
+	id, err := crypto.GenerateKeyFiles(*out, *bits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Key ID: %s\nPrivate key: %s\nPublic key: %s.pub\n", id, *out, *out)
+}
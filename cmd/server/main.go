@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"sync"
 
-	"github.com/fatih/structs"
 	"github.com/go-chi/chi"
 
 	"go.uber.org/zap"
 
 	"github.com/AlekseyKas/metrics/internal/config"
+	"github.com/AlekseyKas/metrics/internal/crypto"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
+	"github.com/AlekseyKas/metrics/internal/server/graphite"
 	"github.com/AlekseyKas/metrics/internal/server/handlers"
 	"github.com/AlekseyKas/metrics/internal/server/helpers"
+	"github.com/AlekseyKas/metrics/internal/server/rpc"
+	"github.com/AlekseyKas/metrics/internal/server/statsd"
 	"github.com/AlekseyKas/metrics/internal/storage"
 )
 
@@ -43,44 +49,67 @@ func main() {
 	storage.InitLogger(logger)
 	// Send logger to handlers
 	handlers.InitLogger(logger)
-	// Inint storage server.
-	s := &storage.MetricsStore{
-		MM:  structs.Map(storage.Metrics{}),
-		Ctx: ctx,
-	}
 	// Terminate environment and flags.
 	config.TermEnvFlags()
 	// Init config
 	handlers.InitConfig(config.ArgsM)
-	// Terminate storage metrics.
-	handlers.SetStorage(s)
-
-	// Load metrics from file.
-	if config.ArgsM.StoreFile != "" {
-		err = helpers.LoadFromFile(logger, config.ArgsM)
+	// Load private keys once, they are reloaded on SIGHUP.
+	if config.ArgsM.PrivateKey != "" {
+		d, err := crypto.NewDecrypter(config.ArgsM.PrivateKey)
 		if err != nil {
-			logger.Error("Error load from file: ", zap.Error(err))
+			logger.Fatal("Error loading private keys: ", zap.Error(err))
 		}
+		handlers.SetDecrypter(d)
+	}
+	// Replay protection signs batches by key.
+	if config.ArgsM.ReplayWindow > 0 && config.ArgsM.Key == "" && config.ArgsM.AgentKeys == "" {
+		logger.Fatal("Replay window is set without key")
 	}
-	// Connect to database if DBURL exist.
-	if config.ArgsM.DBURL != "" {
-		err = handlers.StorageM.InitDB(config.ArgsM.DBURL)
+	if config.ArgsM.ReplayWindow > 0 && config.ArgsM.NonceCacheSize < 1 {
+		logger.Fatal("Size of nonce cache must be positive", zap.Int("nonce_cache_size", config.ArgsM.NonceCacheSize))
+	}
+	// Check trusted subnet before accepting updates.
+	if config.ArgsM.TrustedSubnet != "" {
+		_, _, err = net.ParseCIDR(config.ArgsM.TrustedSubnet)
 		if err != nil {
-			logger.Error("Connection to postrgres faild: ", zap.Error(err))
+			logger.Fatal("Error parsing trusted subnet: ", zap.Error(err))
 		}
-		// Restore from database.
-		if !config.ArgsM.Restore && config.ArgsM.DBURL != "" {
-			err = handlers.StorageM.LoadMetricsDB()
-			if err != nil {
-				logger.Error("Error load metrics to database LoadMetricsDB: ", zap.Error(err))
-			}
+	}
+	// Load TLS config, client certificates are verified if CA is set.
+	var tlsConfig *tls.Config
+	if config.ArgsM.TLSCert != "" {
+		tlsConfig, err = crypto.ServerTLSConfig(config.ArgsM.TLSCert, config.ArgsM.TLSKey, config.ArgsM.TLSCA)
+		if err != nil {
+			logger.Fatal("Error loading TLS config: ", zap.Error(err))
+		}
+	} else if config.ArgsM.TLSCA != "" {
+		logger.Fatal("Client CA is set without TLS certificate of server")
+	}
+	// Init storage backend selected by config, metrics are restored by backend.
+	s, err := storage.New(ctx, config.ArgsM)
+	if err != nil {
+		logger.Fatal("Error init storage: ", zap.Error(err))
+	}
+	// Terminate storage metrics.
+	handlers.SetStorage(s)
+	// Init registry of agent keys, file registry is reloaded on SIGHUP.
+	var agents agentkeys.Registry
+	switch config.ArgsM.AgentKeys {
+	case "":
+	case "postgres":
+		p, ok := s.(*storage.PostgresStorage)
+		if !ok {
+			logger.Fatal("Registry of agent keys in postgres requires database storage")
+		}
+		agents = agentkeys.NewPostgresRegistry(p.Conn)
+	default:
+		agents, err = agentkeys.NewFileRegistry(config.ArgsM.AgentKeys)
+		if err != nil {
+			logger.Fatal("Error loading agent keys: ", zap.Error(err))
 		}
 	}
+	handlers.SetAgents(agents)
 
-	// Add count wait group.
-	wg.Add(1)
-	// Sync metrics with file.
-	go helpers.SyncFile(ctx, &wg, logger, config.ArgsM)
 	// Init chi router.
 	r := chi.NewRouter()
 	r.Route("/", handlers.Router)
@@ -89,14 +118,59 @@ func main() {
 	fmt.Printf("Build date:%s \n", buildDate)
 	fmt.Printf("Build commit:%s \n", buildCommit)
 	// Init http server
-	var srv = http.Server{Addr: config.ArgsM.Address, Handler: r}
+	var srv = http.Server{Addr: config.ArgsM.Address, Handler: r, TLSConfig: tlsConfig}
 	// Add count wait group.
 	wg.Add(1)
 	// Wait signal from operation system.
 	go helpers.WaitSignals(cancel, logger, &wg, &srv)
-	// Start http server.
+	// Start StatsD listener if address is set.
+	if config.ArgsM.StatsDAddress != "" {
+		go func() {
+			err := statsd.ListenAndServe(ctx, config.ArgsM.StatsDAddress, s, logger)
+			if err != nil {
+				logger.Error("Error StatsD listener: ", zap.Error(err))
+			}
+		}()
+	}
+	// Start Graphite listener if address is set.
+	if config.ArgsM.GraphiteAddress != "" {
+		go func() {
+			err := graphite.ListenAndServe(ctx, config.ArgsM.GraphiteAddress, s, logger)
+			if err != nil {
+				logger.Error("Error Graphite listener: ", zap.Error(err))
+			}
+		}()
+	}
+	// Start gRPC server if address is set.
+	if config.ArgsM.GRPCAddress != "" {
+		rpcServer := rpc.NewServer(s, config.ArgsM.Key, logger)
+		err = rpcServer.SetTrustedSubnet(config.ArgsM.TrustedSubnet)
+		if err != nil {
+			logger.Fatal("Error parsing trusted subnet: ", zap.Error(err))
+		}
+		err = rpcServer.SetReplay(config.ArgsM.ReplayWindow, config.ArgsM.NonceCacheSize)
+		if err != nil {
+			logger.Fatal("Error init replay protection of gRPC: ", zap.Error(err))
+		}
+		rpcServer.SetTLS(tlsConfig)
+		rpcServer.SetAgents(agents)
+		rpcServer.SetAllowSharedKey(config.ArgsM.AllowSharedKey)
+		go func() {
+			err := rpc.ListenAndServe(ctx, config.ArgsM.GRPCAddress, rpcServer)
+			if err != nil {
+				logger.Error("Error gRPC server: ", zap.Error(err))
+			}
+		}()
+	}
+	// Start http server, https if TLS is configured.
 	go func() {
-		switch err = srv.ListenAndServe(); err {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		switch err {
 		case nil:
 		case http.ErrServerClosed:
 		default:
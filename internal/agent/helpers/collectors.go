@@ -0,0 +1,92 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// Collector of system metrics, gauges are returned by name
+type collector func() (map[string]float64, error)
+
+// Collectors of system metrics by name in config
+var collectors = map[string]collector{
+	"cpu":  collectCPU,
+	"mem":  collectMemory,
+	"swap": collectSwap,
+	"load": collectLoad,
+}
+
+// Names of enabled collectors from comma-separated list, error if collector is unknown
+func ParseCollectors(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := collectors[name]; !ok {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Utilization of every core as CPUutilization1..N, measured during second
+func collectCPU() (map[string]float64, error) {
+	percents, err := cpu.Percent(time.Second, true)
+	if err != nil {
+		return nil, err
+	}
+	gauges := make(map[string]float64, len(percents))
+	for i, p := range percents {
+		gauges[fmt.Sprintf("CPUutilization%d", i+1)] = p
+	}
+	return gauges, nil
+}
+
+// Virtual memory in bytes
+func collectMemory() (map[string]float64, error) {
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"TotalMemory":     float64(v.Total),
+		"FreeMemory":      float64(v.Free),
+		"UsedMemory":      float64(v.Used),
+		"AvailableMemory": float64(v.Available),
+		"CachedMemory":    float64(v.Cached),
+	}, nil
+}
+
+// Swap in bytes
+func collectSwap() (map[string]float64, error) {
+	s, err := mem.SwapMemory()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"SwapTotal": float64(s.Total),
+		"SwapUsed":  float64(s.Used),
+		"SwapFree":  float64(s.Free),
+	}, nil
+}
+
+// Load averages for 1, 5 and 15 minutes
+func collectLoad() (map[string]float64, error) {
+	avg, err := load.Avg()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"LoadAverage1":  avg.Load1,
+		"LoadAverage5":  avg.Load5,
+		"LoadAverage15": avg.Load15,
+	}, nil
+}
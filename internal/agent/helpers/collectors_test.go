@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+func TestParseCollectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", list: "cpu,mem", want: []string{"cpu", "mem"}},
+		{name: "all with spaces", list: "cpu, mem, swap, load", want: []string{"cpu", "mem", "swap", "load"}},
+		{name: "disabled", list: "", want: nil},
+		{name: "unknown", list: "cpu,disk", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := ParseCollectors(tt.list)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "mem", want: []string{"TotalMemory", "FreeMemory", "UsedMemory", "AvailableMemory", "CachedMemory"}},
+		{name: "swap", want: []string{"SwapTotal", "SwapUsed", "SwapFree"}},
+		{name: "load", want: []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gauges, err := collectors[tt.name]()
+			require.NoError(t, err)
+			require.Len(t, gauges, len(tt.want))
+			for _, id := range tt.want {
+				require.Contains(t, gauges, id)
+			}
+		})
+	}
+	t.Run("cpu", func(t *testing.T) {
+		gauges, err := collectors["cpu"]()
+		require.NoError(t, err)
+		require.NotEmpty(t, gauges)
+		// utilization of every core
+		for i := 1; i <= len(gauges); i++ {
+			require.Contains(t, gauges, fmt.Sprintf("CPUutilization%d", i))
+		}
+	})
+}
+
+func TestUpdateMetricsNewCollectors(t *testing.T) {
+	s := storage.NewMetricsStore()
+	wg := &sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go UpdateMetricsNew(ctx, 10*time.Millisecond, []string{"mem", "load"}, wg, zap.NewNop(), s)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	_, ok := s.GetGauge("UsedMemory")
+	require.True(t, ok)
+	_, ok = s.GetGauge("LoadAverage1")
+	require.True(t, ok)
+	// disabled collectors are not run
+	_, ok = s.GetGauge("SwapTotal")
+	require.False(t, ok)
+	_, ok = s.GetGauge("CPUutilization1")
+	require.False(t, ok)
+}
@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/AlekseyKas/metrics/internal/config"
+	pb "github.com/AlekseyKas/metrics/internal/proto"
+	"github.com/AlekseyKas/metrics/internal/replay"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// Count of metrics in one message of stream
+const streamBatchSize = 100
+
+// Address of gRPC server, address of HTTP server is used if gRPC address is not set
+func grpcAddress() string {
+	if config.ArgsM.GRPCAddress != "" {
+		return config.ArgsM.GRPCAddress
+	}
+	return config.ArgsM.Address
+}
+
+// Connect to gRPC server
+func dialGRPC() (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	return grpc.Dial(grpcAddress(),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
+	)
+}
+
+// Send metrics to gRPC server compressed by gzip, by batches in stream if stream is set, sent counters are reset on success
+func SendMetricsGRPC(ctx context.Context, logger *zap.Logger, client pb.MetricsClient, key []byte, storageM storage.StorageAgent, stream bool) (err error) {
+	JSONMetrics, err := prepareMetrics(ctx, logger, key, storageM)
+	if err != nil {
+		return nil
+	}
+	defer func() { err = sending.finish(storageM, JSONMetrics, err) }()
+	realIP, err := outboundIP(grpcAddress())
+	if err != nil {
+		logger.Error("Error getting outbound address: ", zap.Error(err))
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-real-ip", realIP)
+	if config.ArgsM.AgentID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, agentkeys.MetadataAgentID, config.ArgsM.AgentID)
+	}
+	metrics := make([]*pb.Metric, len(JSONMetrics))
+	for i := range JSONMetrics {
+		metrics[i] = pb.FromJSON(JSONMetrics[i])
+	}
+	// all metrics of call are signed with timestamp and nonce, so call can not be replayed
+	if len(key) > 0 {
+		var body []byte
+		body, err = pb.SignedBody(metrics)
+		if err != nil {
+			return err
+		}
+		var nonce string
+		nonce, err = replay.NewNonce()
+		if err != nil {
+			return err
+		}
+		ts := time.Now().Unix()
+		ctx = metadata.AppendToOutgoingContext(ctx,
+			replay.MetadataTimestamp, strconv.FormatInt(ts, 10),
+			replay.MetadataNonce, nonce,
+			replay.MetadataSignature, replay.Sign(key, ts, nonce, body))
+	}
+	// calls are not retried, status of failed call does not tell whether server saved metrics
+	if !stream {
+		_, err = client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: metrics})
+		return err
+	}
+	s, err := client.StreamMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(metrics); start += streamBatchSize {
+		end := start + streamBatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		err = s.Send(&pb.UpdateMetricsRequest{Metrics: metrics[start:end]})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.CloseAndRecv()
+	return err
+}
@@ -0,0 +1,61 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	pb "github.com/AlekseyKas/metrics/internal/proto"
+	"github.com/AlekseyKas/metrics/internal/server/rpc"
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+func TestSendMetricsGRPC(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream bool
+	}{
+		{name: "unary", stream: false},
+		{name: "stream", stream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := storage.NewMetricsStore()
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			srv := grpc.NewServer()
+			rpcServer := rpc.NewServer(server, "key", zap.NewNop())
+			// calls of agent pass replay protection
+			require.NoError(t, rpcServer.SetReplay(time.Minute, 10))
+			pb.RegisterMetricsServer(srv, rpcServer)
+			go srv.Serve(l)
+			defer srv.Stop()
+
+			conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			require.NoError(t, err)
+			defer conn.Close()
+
+			agent := storage.NewMetricsStore()
+			require.NoError(t, agent.UpdateGauge("Alloc", 42))
+			err = SendMetricsGRPC(context.Background(), zap.NewNop(), pb.NewMetricsClient(conn), []byte("key"), agent, tt.stream)
+			require.NoError(t, err)
+
+			metrics, err := server.GetMetricsJSON()
+			require.NoError(t, err)
+			var found bool
+			for _, m := range metrics {
+				if m.ID == "Alloc" && len(m.Labels) > 0 {
+					found = true
+					require.Equal(t, float64(42), *m.Value)
+				}
+			}
+			require.True(t, found)
+		})
+	}
+}
@@ -4,131 +4,278 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	resty "github.com/go-resty/resty/v2"
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/mem"
 	"go.uber.org/zap"
 
+	"github.com/AlekseyKas/metrics/internal/agent/queue"
 	"github.com/AlekseyKas/metrics/internal/config"
 	"github.com/AlekseyKas/metrics/internal/crypto"
+	pb "github.com/AlekseyKas/metrics/internal/proto"
+	"github.com/AlekseyKas/metrics/internal/replay"
+	"github.com/AlekseyKas/metrics/internal/retry"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
 	"github.com/AlekseyKas/metrics/internal/storage"
 )
 
-// Send metrics to server
-func SendMetrics(ctx context.Context, wg *sync.WaitGroup, logger *zap.Logger, pubKey string, storageM storage.StorageAgent) {
+// TLS config of connections to server, plain connections are used if nil
+var tlsConfig *tls.Config
+
+// HTTP client shared by workers sending metrics
+var httpClient = resty.New()
+
+// Retries of sending report
+var sendRetry = retry.Default
+
+// Queue of batches which are not delivered to server, batches are not kept if nil
+var sendQueue *queue.Queue
+
+// Lock of sending queue
+var queueMu sync.Mutex
+
+// Set retries of sending report from config
+func SetRetry(p retry.Policy) {
+	sendRetry = p
+}
+
+// Set queue opened at startup
+func SetQueue(q *queue.Queue) {
+	sendQueue = q
+}
+
+// Set TLS config loaded at startup
+func SetTLSConfig(cfg *tls.Config) {
+	tlsConfig = cfg
+	httpClient.SetTLSClientConfig(cfg)
+}
+
+// URL of server endpoint with scheme from config, http by default
+func serverURL(address string, path string) string {
+	scheme := config.ArgsM.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + address + path
+}
+
+// Send snapshot of metrics to server every report interval, independently of polling.
+// Reports are sent by RateLimit workers, report waits for free worker if all of them are busy
+func SendMetrics(ctx context.Context, reportInterval time.Duration, wg *sync.WaitGroup, logger *zap.Logger, enc *crypto.Encrypter, storageM storage.StorageAgent) {
 	defer wg.Done()
+	var client pb.MetricsClient
+	if config.ArgsM.Transport == "grpc" || config.ArgsM.Transport == "grpc-stream" {
+		conn, err := dialGRPC()
+		if err != nil {
+			logger.Error("Error connect to gRPC server: ", zap.Error(err))
+			return
+		}
+		defer conn.Close()
+		client = pb.NewMetricsClient(conn)
+	}
+	send := func(ctx context.Context) error {
+		switch config.ArgsM.Transport {
+		case "grpc":
+			return SendMetricsGRPC(ctx, logger, client, []byte(config.ArgsM.Key), storageM, false)
+		case "grpc-stream":
+			return SendMetricsGRPC(ctx, logger, client, []byte(config.ArgsM.Key), storageM, true)
+		default:
+			return SendMetricsSlice(ctx, logger, config.ArgsM.Address, enc, []byte(config.ArgsM.Key), storageM)
+		}
+	}
+	jobs := make(chan sendJob)
+	workers := runWorkers(ctx, config.ArgsM.RateLimit, logger, jobs)
+	defer workers.Wait()
+	defer close(jobs)
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			logger.Info("Agent is down send metrics.")
 			return
-		case <-time.After(config.ArgsM.PollInterval):
-			err := SendMetricsSlice(ctx, logger, config.ArgsM.Address, pubKey, []byte(config.ArgsM.Key), storageM)
-			if err != nil {
-				logger.Error("Error sending POST: ", zap.Error(err))
+		case <-ticker.C:
+			select {
+			case jobs <- send:
+			case <-ctx.Done():
+				logger.Info("Agent is down send metrics.")
+				return
 			}
 		}
 	}
 }
 
-// Prepare and sending metrics to server
-func SendMetricsSlice(ctx context.Context, logger *zap.Logger, address string, pubKey string, key []byte, storageM storage.StorageAgent) error {
-	client := resty.New()
-
-	JSONMetrics, err := storageM.GetMetricsJSON()
+// Prepare and sending metrics to server, sent counters are reset when server accepts batch or batch is queued
+func SendMetricsSlice(ctx context.Context, logger *zap.Logger, address string, enc *crypto.Encrypter, key []byte, storageM storage.StorageAgent) (err error) {
+	JSONMetrics, err := prepareMetrics(ctx, logger, key, storageM)
 	if err != nil {
-		logger.Error("Error getting metrics json format", zap.Error(err))
-	}
-
-	for i := 0; i < len(JSONMetrics); i++ {
-		select {
-		case <-ctx.Done():
-			logger.Info("Send metrics in map ending!")
-			return nil
-		default:
-			if string(key) != "" {
-				_, err = saveHash(&JSONMetrics[i], []byte(key))
-				if err != nil {
-					logger.Error("Error save hash of metrics: ", zap.Error(err))
-				}
-			}
-		}
+		return nil
 	}
+	defer func() { err = sending.finish(storageM, JSONMetrics, err) }()
 	var buf bytes.Buffer
-	var b bytes.Buffer
 
 	encoder := json.NewEncoder(&buf)
 	err = encoder.Encode(&JSONMetrics)
 	if err != nil {
 		logger.Error("Error encoding JSON metrics", zap.Error(err))
 	}
+	realIP, err := outboundIP(address)
+	if err != nil {
+		logger.Error("Error getting outbound address: ", zap.Error(err))
+	}
+	if sendQueue == nil {
+		return sendBatch(ctx, logger, address, enc, key, buf.Bytes(), realIP)
+	}
+	return sendQueued(ctx, logger, address, enc, key, buf.Bytes(), realIP)
+}
 
+// Send batches of queue in order and then batch, batch is queued if server is unavailable.
+// Queue is sent by one worker at once to keep order of batches
+func sendQueued(ctx context.Context, logger *zap.Logger, address string, enc *crypto.Encrypter, key []byte, batch []byte, realIP string) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	err := sendQueue.Drain(func(data []byte) error {
+		err := sendBatch(ctx, logger, address, enc, key, data, realIP)
+		if err != nil && !retry.IsRetriable(err) && ctx.Err() == nil {
+			logger.Error("Queued batch is rejected by server and dropped: ", zap.Error(err))
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		err = sendBatch(ctx, logger, address, enc, key, batch, realIP)
+	}
+	// batch rejected by server is not queued, batch of stopping agent is sent after restart
+	if err == nil || (!retry.IsRetriable(err) && ctx.Err() == nil) {
+		return err
+	}
+	logger.Warn("Server is unavailable, batch is queued: ", zap.Error(err))
+	return sendQueue.Push(batch)
+}
+
+// Compress, encrypt and post JSON batch with retries
+func sendBatch(ctx context.Context, logger *zap.Logger, address string, enc *crypto.Encrypter, key []byte, batch []byte, realIP string) error {
+	var b bytes.Buffer
 	gz, _ := gzip.NewWriterLevel(&b, gzip.BestSpeed)
 
-	_, err = gz.Write(buf.Bytes())
+	_, err := gz.Write(batch)
 	if err != nil {
 		logger.Error("Error write gz metrics: ", zap.Error(err))
 	}
 	gz.Close()
 	// Encryption
-	if pubKey != "" {
-
-		var data []byte
-		data, err = crypto.EncryptData(b.Bytes(), pubKey)
-		if err != nil {
-			logger.Error("Error encrypt data: ", zap.Error(err))
-		}
-		_, err = client.R().
-			SetHeader("Content-Encoding", "gzip").
-			SetHeader("Content-Type", "application/json").
-			SetBody(data).
-			Post("http://" + address + "/updates/")
+	body := b.Bytes()
+	if enc != nil {
+		body, err = enc.Encrypt(body)
 		if err != nil {
 			return err
 		}
-		return nil
-	} else {
-		_, err = client.R().
-			SetHeader("Content-Encoding", "gzip").
-			SetHeader("Content-Type", "application/json").
-			SetBody(&b).
-			Post("http://" + address + "/updates/")
+	}
+	return sendRetry.Do(ctx, func() error {
+		return postBatch(ctx, address, key, batch, body, realIP)
+	})
+}
+
+// Post batch to /updates/, every attempt is signed with new nonce. Only errors before batch is saved are retriable
+func postBatch(ctx context.Context, address string, key []byte, batch []byte, body []byte, realIP string) error {
+	req := httpClient.R().SetContext(ctx).
+		SetHeader("Content-Encoding", "gzip").
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Real-IP", realIP)
+	if config.ArgsM.AgentID != "" {
+		req.SetHeader(agentkeys.HeaderAgentID, config.ArgsM.AgentID)
+	}
+	// Batch is signed as a whole, timestamp and nonce signed with body protect it from replay
+	if len(key) > 0 {
+		req.SetHeader(storage.HeaderHash, storage.HashBatch(batch, key))
+		nonce, err := replay.NewNonce()
 		if err != nil {
 			return err
 		}
+		ts := time.Now().Unix()
+		req.SetHeader(replay.HeaderTimestamp, strconv.FormatInt(ts, 10)).
+			SetHeader(replay.HeaderNonce, nonce).
+			SetHeader(replay.HeaderSignature, replay.Sign(key, ts, nonce, batch))
+	}
+	resp, err := req.SetBody(body).Post(serverURL(address, "/updates/"))
+	if err != nil {
+		return err
+	}
+	// batch is rejected before it is saved, other server errors can come after batch is saved
+	if resp.StatusCode() == http.StatusServiceUnavailable || resp.StatusCode() == http.StatusTooManyRequests {
+		return retry.Retriable(fmt.Errorf("server responded %s", resp.Status()))
+	}
+	if resp.IsError() {
+		return fmt.Errorf("server responded %s", resp.Status())
+	}
+	return nil
+}
+
+// Get metrics of agent with labels and hashes, error if context is done.
+// Counters of metrics are in flight until report is finished
+func prepareMetrics(ctx context.Context, logger *zap.Logger, key []byte, storageM storage.StorageAgent) ([]storage.JSONMetrics, error) {
+	JSONMetrics, err := sending.snapshot(storageM)
+	if err != nil {
+		logger.Error("Error getting metrics json format", zap.Error(err))
+	}
+
+	labels := agentLabels()
+	for i := 0; i < len(JSONMetrics); i++ {
+		select {
+		case <-ctx.Done():
+			logger.Info("Send metrics in map ending!")
+			return nil, sending.finish(storageM, JSONMetrics, ctx.Err())
+		default:
+			JSONMetrics[i].Labels = labels
+			if string(key) != "" {
+				_, err = saveHash(&JSONMetrics[i], []byte(key))
+				if err != nil {
+					logger.Error("Error save hash of metrics: ", zap.Error(err))
+				}
+			}
+		}
+	}
+	return JSONMetrics, nil
+}
+
+// Address of interface used to reach server, nothing is sent by UDP dial
+func outboundIP(address string) (string, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	return host, err
+}
+
+// Labels attached to every metric of agent
+func agentLabels() map[string]string {
+	host := config.ArgsM.HostLabel
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	if host == "" {
 		return nil
 	}
+	return map[string]string{"host": host}
 }
 
 // Set sha256 hash for metric
 func saveHash(JSONMetric *storage.JSONMetrics, key []byte) (hash string, err error) {
-	var hh string
-	switch JSONMetric.MType {
-	case "counter":
-		data := (fmt.Sprintf("%s:counter:%d", JSONMetric.ID, *JSONMetric.Delta))
-		h := hmac.New(sha256.New, key)
-		h.Write([]byte(data))
-		JSONMetric.Hash = fmt.Sprintf("%x", h.Sum(nil))
-		hh = fmt.Sprintf("%x", h.Sum(nil))
-	case "gauge":
-		data := (fmt.Sprintf("%s:gauge:%f", JSONMetric.ID, *JSONMetric.Value))
-		h := hmac.New(sha256.New, key)
-		h.Write([]byte(data))
-		JSONMetric.Hash = fmt.Sprintf("%x", h.Sum(nil))
-		hh = fmt.Sprintf("%x", h.Sum(nil))
-	}
-	return hh, nil
+	JSONMetric.Hash, err = storage.Hash(JSONMetric, key)
+	return JSONMetric.Hash, err
 }
 
 //Update metrics terminating
@@ -151,8 +298,8 @@ func UpdateMetrics(ctx context.Context, pollInterval time.Duration, wg *sync.Wai
 	}
 }
 
-//Update new metrics
-func UpdateMetricsNew(ctx context.Context, pollInterval time.Duration, wg *sync.WaitGroup, logger *zap.Logger, storageM storage.StorageAgent) {
+// Update system metrics by enabled collectors
+func UpdateMetricsNew(ctx context.Context, pollInterval time.Duration, names []string, wg *sync.WaitGroup, logger *zap.Logger, storageM storage.StorageAgent) {
 	defer wg.Done()
 	for {
 		select {
@@ -160,18 +307,42 @@ func UpdateMetricsNew(ctx context.Context, pollInterval time.Duration, wg *sync.
 			logger.Info("Agent is down update metrics mem & cpu!")
 			return
 		case <-time.After(pollInterval):
-			mem, err := mem.VirtualMemory()
-			if err != nil {
-				logger.Error("Error get metic Virtualmemory: ", zap.Error(err))
+			// collectors do not depend on each other, error of one of them does not stop others
+			gauges := map[string]float64{}
+			for _, name := range names {
+				values, err := collectors[name]()
+				if err != nil {
+					logger.Error("Error collecting metrics: ", zap.String("collector", name), zap.Error(err))
+					continue
+				}
+				for k, v := range values {
+					gauges[k] = v
+				}
 			}
-			cpu, err := cpu.Percent(time.Second, false)
+			err := storageM.ChangeGauges(gauges)
 			if err != nil {
-				logger.Error("Error get metric cpu cover: ", zap.Error(err))
+				logger.Error("Error change new metrics ChangeGauges: ", zap.Error(err))
 			}
-			err = storageM.ChangeMetricsNew(mem, cpu)
+		}
+	}
+}
+
+// Reload public key on SIGHUP until context is done
+func ReloadKeys(ctx context.Context, logger *zap.Logger, enc *crypto.Encrypter) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			err := enc.Reload()
 			if err != nil {
-				logger.Error("Error change new metrics ChangeMetricsNew: ", zap.Error(err))
+				logger.Error("Error reloading public key: ", zap.Error(err))
+				continue
 			}
+			logger.Info("Public key reloaded")
 		}
 	}
 }
@@ -0,0 +1,81 @@
+package helpers
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// Sending of one report to server
+type sendJob func(ctx context.Context) error
+
+// Run workers sending jobs until channel is closed, at most limit requests are in flight
+func runWorkers(ctx context.Context, limit int, logger *zap.Logger, jobs <-chan sendJob) *sync.WaitGroup {
+	if limit < 1 {
+		limit = 1
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(limit)
+	for i := 0; i < limit; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				err := job(ctx)
+				if err != nil {
+					logger.Error("Error sending metrics: ", zap.Error(err))
+				}
+			}
+		}()
+	}
+	return wg
+}
+
+// Counter deltas of reports which are sent but not confirmed yet
+type inflight struct {
+	mu     sync.Mutex
+	deltas map[string]int64
+}
+
+// Counters in flight of agent, metrics of agent storage have no labels so they are keyed by ID
+var sending = &inflight{deltas: map[string]int64{}}
+
+// Snapshot of metrics, counters carry only increments which are not in flight in other reports
+func (f *inflight) snapshot(storageM storage.StorageAgent) ([]storage.JSONMetrics, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	metrics, err := storageM.GetMetricsJSON()
+	if err != nil {
+		return nil, err
+	}
+	for i := range metrics {
+		if metrics[i].MType != "counter" || metrics[i].Delta == nil {
+			continue
+		}
+		delta := *metrics[i].Delta - f.deltas[metrics[i].ID]
+		f.deltas[metrics[i].ID] += delta
+		metrics[i].Delta = &delta
+	}
+	return metrics, nil
+}
+
+// Finish report, counters are reset if report is sent without error and returned to next reports otherwise
+func (f *inflight) finish(storageM storage.StorageAgent, sent []storage.JSONMetrics, err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		err = storageM.ResetCounters(sent)
+	}
+	for _, m := range sent {
+		if m.MType != "counter" || m.Delta == nil {
+			continue
+		}
+		f.deltas[m.ID] -= *m.Delta
+		if f.deltas[m.ID] == 0 {
+			delete(f.deltas, m.ID)
+		}
+	}
+	return err
+}
@@ -0,0 +1,330 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of segment after which new segment is started
+const defaultSegmentSize = 1 << 20
+
+// Size of record header: length and CRC32 of data
+const headerSize = 8
+
+// Name of file with position of first record in queue
+const headFile = "head"
+
+// Errors of queue
+var (
+	ErrEmpty   = errors.New("queue is empty")
+	ErrCorrupt = errors.New("record of queue is corrupted")
+)
+
+// File of queue with records appended in order
+type segment struct {
+	seq     uint64
+	size    int64
+	updated time.Time
+}
+
+// Queue of batches in segment files of directory, it keeps position of first batch between restarts.
+// Oldest segments are dropped when size of queue is over maxSize or they are older than maxAge
+type Queue struct {
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	mu          sync.Mutex
+	segments    []segment
+	offset      int64
+}
+
+// Open queue in directory, batches left by previous run are kept. Caps are disabled if they are zero
+func Open(dir string, maxSize int64, maxAge time.Duration) (*Queue, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		segmentSize: defaultSegmentSize,
+	}
+	// small queue is split to several segments, so dropping oldest one keeps most of batches
+	if maxSize > 0 && maxSize/4 < q.segmentSize {
+		q.segmentSize = maxSize/4 + 1
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		seq, ok := parseSegmentName(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, segment{seq: seq, size: info.Size(), updated: info.ModTime()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+	err = q.loadHead()
+	if err != nil {
+		return nil, err
+	}
+	// tail of previous run can end with partly written record, new batches go to new segment
+	if len(q.segments) > 0 {
+		q.segments = append(q.segments, segment{seq: q.segments[len(q.segments)-1].seq + 1})
+	}
+	q.enforceCaps(time.Now())
+	return q, nil
+}
+
+// Append batch to the end of queue
+func (q *Queue) Push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if len(q.segments) == 0 || q.segments[len(q.segments)-1].size >= q.segmentSize {
+		var seq uint64
+		if len(q.segments) > 0 {
+			seq = q.segments[len(q.segments)-1].seq + 1
+		}
+		q.segments = append(q.segments, segment{seq: seq})
+	}
+	tail := &q.segments[len(q.segments)-1]
+	f, err := os.OpenFile(q.segmentPath(tail.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+	_, err = f.Write(record)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// record can be written partly, next batches go to new segment
+		tail.size += q.segmentSize
+		return err
+	}
+	tail.size += int64(len(record))
+	tail.updated = now
+	q.enforceCaps(now)
+	return nil
+}
+
+// First batch of queue, ErrEmpty if there are no batches
+func (q *Queue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.enforceCaps(time.Now())
+	data, _, err := q.first()
+	return data, err
+}
+
+// Remove first batch of queue
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, size, err := q.first()
+	if err != nil {
+		return err
+	}
+	q.offset += size
+	return q.saveHead()
+}
+
+// Count of bytes of segments in queue
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size()
+}
+
+// Read first record, segments read to the end are removed. Corrupted rest of segment is skipped
+func (q *Queue) first() ([]byte, int64, error) {
+	for len(q.segments) > 0 {
+		s := q.segments[0]
+		// last segment without records is not created yet
+		if len(q.segments) == 1 && s.size == 0 {
+			return nil, 0, ErrEmpty
+		}
+		data, err := q.read(s.seq, q.offset)
+		if err == nil {
+			return data, int64(headerSize + len(data)), nil
+		}
+		if !errors.Is(err, io.EOF) && !errors.Is(err, ErrCorrupt) {
+			return nil, 0, err
+		}
+		err = q.dropFirst()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, ErrEmpty
+}
+
+// Read record of segment at offset, io.EOF if there are no full records after offset
+func (q *Queue) read(seq uint64, offset int64) ([]byte, error) {
+	f, err := os.Open(q.segmentPath(seq))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, headerSize)
+	_, err = f.ReadAt(header, offset)
+	if err != nil {
+		return nil, io.EOF
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+headerSize+length > info.Size() {
+		return nil, io.EOF
+	}
+	data := make([]byte, length)
+	_, err = f.ReadAt(data, offset+headerSize)
+	if err != nil {
+		return nil, io.EOF
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("%w: segment %d offset %d", ErrCorrupt, seq, offset)
+	}
+	return data, nil
+}
+
+// Drop segments older than maxAge and oldest segments while queue is bigger than maxSize,
+// active segment is dropped too if it alone is bigger than maxSize
+func (q *Queue) enforceCaps(now time.Time) {
+	for len(q.segments) > 0 && q.maxAge > 0 && q.segments[0].size > 0 && now.Sub(q.segments[0].updated) > q.maxAge {
+		if q.dropFirst() != nil {
+			return
+		}
+	}
+	for len(q.segments) > 0 && q.maxSize > 0 && q.size() > q.maxSize {
+		if q.dropFirst() != nil {
+			return
+		}
+	}
+}
+
+// Count of bytes of segments, mutex is held by caller
+func (q *Queue) size() int64 {
+	var size int64
+	for _, s := range q.segments {
+		size += s.size
+	}
+	return size
+}
+
+// Remove first segment and move head to start of next one
+func (q *Queue) dropFirst() error {
+	err := os.Remove(q.segmentPath(q.segments[0].seq))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(q.segments) == 1 {
+		q.segments[0] = segment{seq: q.segments[0].seq + 1}
+	} else {
+		q.segments = q.segments[1:]
+	}
+	q.offset = 0
+	return q.saveHead()
+}
+
+// Store position of first record, file is replaced atomically
+func (q *Queue) saveHead() error {
+	tmp := filepath.Join(q.dir, headFile+".tmp")
+	err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", q.segments[0].seq, q.offset)), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, headFile))
+}
+
+// Restore position of first record, segments before head are removed
+func (q *Queue) loadHead() error {
+	b, err := os.ReadFile(filepath.Join(q.dir, headFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	var offset int64
+	_, err = fmt.Sscanf(string(b), "%d %d", &seq, &offset)
+	if err != nil {
+		return fmt.Errorf("invalid head of queue: %w", err)
+	}
+	for len(q.segments) > 0 && q.segments[0].seq < seq {
+		err = os.Remove(q.segmentPath(q.segments[0].seq))
+		if err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 && q.segments[0].seq == seq {
+		q.offset = offset
+	}
+	return nil
+}
+
+// Path of segment file
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+// Sequence number of segment by file name
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".seg") {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+	return seq, err == nil
+}
+
+// Send batches from the start of queue, sent batch is removed. Sending stops on first error of send
+func (q *Queue) Drain(send func(data []byte) error) error {
+	for {
+		data, err := q.Peek()
+		if errors.Is(err, ErrEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = send(data)
+		if err != nil {
+			return err
+		}
+		err = q.Pop()
+		if err != nil {
+			return err
+		}
+	}
+}
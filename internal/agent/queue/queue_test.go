@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Send all batches of queue
+func drain(t *testing.T, q *Queue) []string {
+	var batches []string
+	err := q.Drain(func(data []byte) error {
+		batches = append(batches, string(data))
+		return nil
+	})
+	require.NoError(t, err)
+	return batches
+}
+
+func TestQueueOrder(t *testing.T) {
+	q, err := Open(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	q.segmentSize = 32
+	_, err = q.Peek()
+	require.ErrorIs(t, err, ErrEmpty)
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("batch-%d", i))
+		require.NoError(t, q.Push([]byte(want[i])))
+	}
+	require.Greater(t, len(q.segments), 1)
+	require.Equal(t, want, drain(t, q))
+	// read segments are removed
+	require.Equal(t, int64(0), q.Size())
+	require.NoError(t, q.Push([]byte("next")))
+	require.Equal(t, []string{"next"}, drain(t, q))
+}
+
+func TestQueueDrainError(t *testing.T) {
+	q, err := Open(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Push([]byte("batch-0")))
+	require.NoError(t, q.Push([]byte("batch-1")))
+	failed := errors.New("server is unavailable")
+	err = q.Drain(func(data []byte) error {
+		if string(data) == "batch-1" {
+			return failed
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, failed)
+	// batch is kept until it is sent
+	require.Equal(t, []string{"batch-1"}, drain(t, q))
+}
+
+func TestQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 0, 0)
+	require.NoError(t, err)
+	q.segmentSize = 32
+	for i := 0; i < 6; i++ {
+		require.NoError(t, q.Push([]byte(fmt.Sprintf("batch-%d", i))))
+	}
+	for i := 0; i < 4; i++ {
+		require.NoError(t, q.Pop())
+	}
+
+	q, err = Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Push([]byte("batch-6")))
+	require.Equal(t, []string{"batch-4", "batch-5", "batch-6"}, drain(t, q))
+}
+
+func TestQueueCorruptedTail(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Push([]byte("batch-0")))
+	// record written partly before crash
+	f, err := os.OpenFile(q.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 100, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Push([]byte("batch-1")))
+	require.Equal(t, []string{"batch-0", "batch-1"}, drain(t, q))
+}
+
+func TestQueueCaps(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		q, err := Open(t.TempDir(), 64, 0)
+		require.NoError(t, err)
+		q.segmentSize = 16
+		for i := 0; i < 10; i++ {
+			require.NoError(t, q.Push([]byte(fmt.Sprintf("batch-%d", i))))
+		}
+		require.LessOrEqual(t, q.Size(), int64(64))
+		// oldest batches are dropped
+		require.Equal(t, []string{"batch-6", "batch-7", "batch-8", "batch-9"}, drain(t, q))
+	})
+	t.Run("size smaller than segment", func(t *testing.T) {
+		q, err := Open(t.TempDir(), 40, 0)
+		require.NoError(t, err)
+		require.Less(t, q.segmentSize, int64(40))
+		for i := 0; i < 10; i++ {
+			require.NoError(t, q.Push([]byte(fmt.Sprintf("batch-%d", i))))
+			require.LessOrEqual(t, q.Size(), int64(40))
+		}
+		require.Equal(t, []string{"batch-8", "batch-9"}, drain(t, q))
+	})
+	t.Run("batch bigger than size", func(t *testing.T) {
+		q, err := Open(t.TempDir(), 10, 0)
+		require.NoError(t, err)
+		require.NoError(t, q.Push([]byte("batch-0")))
+		require.LessOrEqual(t, q.Size(), int64(10))
+		require.Empty(t, drain(t, q))
+	})
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		q, err := Open(dir, 0, time.Hour)
+		require.NoError(t, err)
+		q.segmentSize = 8
+		require.NoError(t, q.Push([]byte("old")))
+		require.NoError(t, q.Push([]byte("new")))
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, fmt.Sprintf("%020d.seg", 0)), old, old))
+
+		q, err = Open(dir, 0, time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, []string{"new"}, drain(t, q))
+	})
+}
@@ -19,14 +19,29 @@ var FlagsAgent FlagsAg
 
 // Server flags.
 type FlagsServ struct {
-	Address       string
-	Key           string
-	StoreFile     string
-	PrivateKey    string
-	DBURL         string
-	Config        string
-	Restore       bool
-	StoreInterval time.Duration
+	Address         string
+	Key             string
+	StoreFile       string
+	PrivateKey      string
+	DBURL           string
+	Config          string
+	Storage         string
+	StatsDAddress   string
+	GraphiteAddress string
+	GRPCAddress     string
+	TrustedSubnet   string
+	TLSCert         string
+	TLSKey          string
+	TLSCA           string
+	AgentKeys       string
+	RetryBackoff    string
+	Restore         bool
+	AllowSharedKey  bool
+	SeriesLimit     int
+	NonceCacheSize  int
+	RetryAttempts   int
+	StoreInterval   time.Duration
+	ReplayWindow    time.Duration
 }
 
 // Agent flags.
@@ -35,38 +50,101 @@ type FlagsAg struct {
 	Key            string
 	PubKey         string
 	Config         string
+	HostLabel      string
+	Transport      string
+	GRPCAddress    string
+	Scheme         string
+	TLSCert        string
+	TLSKey         string
+	TLSCA          string
+	AgentID        string
+	QueueDir       string
+	Collectors     string
+	RetryBackoff   string
+	RateLimit      int
+	QueueMaxSize   int
+	RetryAttempts  int
 	ReportInterval time.Duration
 	PollInterval   time.Duration
+	QueueMaxAge    time.Duration
 }
 
 // Parametrs enviroment for server.
 type Param struct {
-	Key            string        `env:"KEY"`
-	DBURL          string        `env:"DATABASE_DSN"`
-	Address        string        `env:"ADDRESS" envDefault:"127.0.0.1:8080"`
-	PubKey         string        `env:"CRYPTO_KEY"`
-	PrivateKey     string        `env:"CRYPTO_KEY"`
-	StoreFile      string        `env:"STORE_FILE" envDefault:"/tmp/devops-metrics-db.json"`
-	Config         string        `env:"CONFIG"`
-	Restore        bool          `env:"RESTORE" envDefault:"true"`
-	PollInterval   time.Duration `env:"POLL_INTERVAL" envDefault:"2s"`
-	ReportInterval time.Duration `env:"REPORT_INTERVAL" envDefault:"10s"`
-	StoreInterval  time.Duration `env:"STORE_INTERVAL" envDefault:"300s"`
+	Key             string        `env:"KEY"`
+	DBURL           string        `env:"DATABASE_DSN"`
+	Address         string        `env:"ADDRESS" envDefault:"127.0.0.1:8080"`
+	PubKey          string        `env:"CRYPTO_KEY"`
+	PrivateKey      string        `env:"CRYPTO_KEY"`
+	StoreFile       string        `env:"STORE_FILE" envDefault:"/tmp/devops-metrics-db.json"`
+	Config          string        `env:"CONFIG"`
+	Storage         string        `env:"STORAGE"`
+	HostLabel       string        `env:"HOST_LABEL"`
+	StatsDAddress   string        `env:"STATSD_ADDRESS"`
+	GraphiteAddress string        `env:"GRAPHITE_ADDRESS"`
+	GRPCAddress     string        `env:"GRPC_ADDRESS"`
+	Transport       string        `env:"TRANSPORT"`
+	TrustedSubnet   string        `env:"TRUSTED_SUBNET"`
+	Scheme          string        `env:"SCHEME"`
+	TLSCert         string        `env:"TLS_CERT"`
+	TLSKey          string        `env:"TLS_KEY"`
+	TLSCA           string        `env:"TLS_CA"`
+	AgentKeys       string        `env:"AGENT_KEYS"`
+	AgentID         string        `env:"AGENT_ID"`
+	Restore         bool          `env:"RESTORE" envDefault:"true"`
+	AllowSharedKey  bool          `env:"ALLOW_SHARED_KEY"`
+	SeriesLimit     int           `env:"SERIES_LIMIT" envDefault:"1000"`
+	NonceCacheSize  int           `env:"NONCE_CACHE_SIZE" envDefault:"100000"`
+	RateLimit       int           `env:"RATE_LIMIT" envDefault:"1"`
+	QueueDir        string        `env:"QUEUE_DIR"`
+	Collectors      string        `env:"COLLECTORS" envDefault:"cpu,mem"`
+	QueueMaxSize    int           `env:"QUEUE_MAX_SIZE" envDefault:"67108864"`
+	QueueMaxAge     time.Duration `env:"QUEUE_MAX_AGE" envDefault:"24h"`
+	RetryAttempts   int           `env:"RETRY_ATTEMPTS" envDefault:"4"`
+	RetryBackoff    string        `env:"RETRY_BACKOFF" envDefault:"1s,3s,5s"`
+	ReplayWindow    time.Duration `env:"REPLAY_WINDOW"`
+	PollInterval    time.Duration `env:"POLL_INTERVAL" envDefault:"2s"`
+	ReportInterval  time.Duration `env:"REPORT_INTERVAL" envDefault:"10s"`
+	StoreInterval   time.Duration `env:"STORE_INTERVAL" envDefault:"300s"`
 }
 
 // Parametrs enviroment for agent.
 type Args struct {
-	DBURL          string
-	Address        string
-	Key            string
-	StoreFile      string
-	PubKey         string
-	PrivateKey     string
-	Config         string
-	Restore        bool
-	PollInterval   time.Duration
-	ReportInterval time.Duration
-	StoreInterval  time.Duration
+	DBURL           string
+	Address         string
+	Key             string
+	StoreFile       string
+	PubKey          string
+	PrivateKey      string
+	Config          string
+	HostLabel       string
+	Storage         string
+	StatsDAddress   string
+	GraphiteAddress string
+	GRPCAddress     string
+	Transport       string
+	TrustedSubnet   string
+	Scheme          string
+	TLSCert         string
+	TLSKey          string
+	TLSCA           string
+	AgentKeys       string
+	AgentID         string
+	Restore         bool
+	AllowSharedKey  bool
+	SeriesLimit     int
+	NonceCacheSize  int
+	RateLimit       int
+	QueueDir        string
+	QueueMaxSize    int
+	Collectors      string
+	RetryAttempts   int
+	RetryBackoff    string
+	QueueMaxAge     time.Duration
+	PollInterval    time.Duration
+	ReportInterval  time.Duration
+	StoreInterval   time.Duration
+	ReplayWindow    time.Duration
 }
 
 // Variable for environment and flags
@@ -88,11 +166,26 @@ func TermEnvFlags() {
 	flag.StringVar(&FlagsServer.DBURL, "d", "", "Database URL")
 	flag.StringVar(&FlagsServer.StoreFile, "f", "", "File path store")
 	flag.StringVar(&FlagsServer.Key, "k", "", "Secret key")
-	flag.StringVar(&FlagsServer.PrivateKey, "crypto-key", "", "Private key")
+	flag.StringVar(&FlagsServer.PrivateKey, "crypto-key", "", "Private keys separated by comma, all of them are accepted during rotation")
 	flag.StringVar(&FlagsServer.Config, "c", "", "Path configuration file")
 	flag.StringVar(&FlagsServer.Config, "config", "", "Path configuration file")
 	flag.BoolVar(&FlagsServer.Restore, "r", true, "Restore from file")
 	flag.DurationVar(&FlagsServer.StoreInterval, "i", 300000000000, "Interval store file")
+	flag.IntVar(&FlagsServer.SeriesLimit, "series-limit", 1000, "Count of samples kept in memory and database for every metric")
+	flag.StringVar(&FlagsServer.Storage, "storage", "", "Storage backend: memory, file or postgres")
+	flag.StringVar(&FlagsServer.StatsDAddress, "statsd-address", "", "UDP address of StatsD listener, disabled if empty")
+	flag.StringVar(&FlagsServer.GraphiteAddress, "graphite-address", "", "TCP address of Graphite listener, disabled if empty")
+	flag.StringVar(&FlagsServer.GRPCAddress, "grpc-address", "", "Address of gRPC server, disabled if empty")
+	flag.StringVar(&FlagsServer.TrustedSubnet, "t", "", "Trusted subnet in CIDR notation, updates from other addresses are rejected")
+	flag.StringVar(&FlagsServer.TLSCert, "tls-cert", "", "TLS certificate of server, HTTPS is disabled if empty")
+	flag.StringVar(&FlagsServer.TLSKey, "tls-key", "", "TLS private key of server")
+	flag.StringVar(&FlagsServer.TLSCA, "tls-ca", "", "CA bundle verifying client certificates, mTLS is disabled if empty")
+	flag.StringVar(&FlagsServer.AgentKeys, "agent-keys", "", "JSON file of keys by agent ID or postgres for table agent_keys, shared key is used if empty. Updates by URL are not signed and not checked")
+	flag.BoolVar(&FlagsServer.AllowSharedKey, "allow-shared-key", false, "Accept updates without agent ID signed by shared key when agent keys are set")
+	flag.DurationVar(&FlagsServer.ReplayWindow, "replay-window", 0, "Window of accepted timestamps of signed updates by JSON, batches and gRPC, replay protection is disabled if zero")
+	flag.IntVar(&FlagsServer.NonceCacheSize, "nonce-cache-size", 100000, "Count of batch nonces kept for replay protection")
+	flag.IntVar(&FlagsServer.RetryAttempts, "retry-attempts", 4, "Count of attempts of database connection and writes")
+	flag.StringVar(&FlagsServer.RetryBackoff, "retry-backoff", "1s,3s,5s", "Comma-separated delays between attempts, last delay is repeated")
 	flag.Parse()
 	env := loadConfig()
 
@@ -127,6 +220,96 @@ func TermEnvFlags() {
 	} else {
 		ArgsM.Key = env.Key
 	}
+	envStorage, _ := os.LookupEnv("STORAGE")
+	if envStorage == "" {
+		ArgsM.Storage = FlagsServer.Storage
+	} else {
+		ArgsM.Storage = env.Storage
+	}
+	envStatsDAddress, _ := os.LookupEnv("STATSD_ADDRESS")
+	if envStatsDAddress == "" {
+		ArgsM.StatsDAddress = FlagsServer.StatsDAddress
+	} else {
+		ArgsM.StatsDAddress = env.StatsDAddress
+	}
+	envGraphiteAddress, _ := os.LookupEnv("GRAPHITE_ADDRESS")
+	if envGraphiteAddress == "" {
+		ArgsM.GraphiteAddress = FlagsServer.GraphiteAddress
+	} else {
+		ArgsM.GraphiteAddress = env.GraphiteAddress
+	}
+	envGRPCAddress, _ := os.LookupEnv("GRPC_ADDRESS")
+	if envGRPCAddress == "" {
+		ArgsM.GRPCAddress = FlagsServer.GRPCAddress
+	} else {
+		ArgsM.GRPCAddress = env.GRPCAddress
+	}
+	envTrustedSubnet, _ := os.LookupEnv("TRUSTED_SUBNET")
+	if envTrustedSubnet == "" {
+		ArgsM.TrustedSubnet = FlagsServer.TrustedSubnet
+	} else {
+		ArgsM.TrustedSubnet = env.TrustedSubnet
+	}
+	envTLSCert, _ := os.LookupEnv("TLS_CERT")
+	if envTLSCert == "" {
+		ArgsM.TLSCert = FlagsServer.TLSCert
+	} else {
+		ArgsM.TLSCert = env.TLSCert
+	}
+	envTLSKey, _ := os.LookupEnv("TLS_KEY")
+	if envTLSKey == "" {
+		ArgsM.TLSKey = FlagsServer.TLSKey
+	} else {
+		ArgsM.TLSKey = env.TLSKey
+	}
+	envTLSCA, _ := os.LookupEnv("TLS_CA")
+	if envTLSCA == "" {
+		ArgsM.TLSCA = FlagsServer.TLSCA
+	} else {
+		ArgsM.TLSCA = env.TLSCA
+	}
+	envAgentKeys, _ := os.LookupEnv("AGENT_KEYS")
+	if envAgentKeys == "" {
+		ArgsM.AgentKeys = FlagsServer.AgentKeys
+	} else {
+		ArgsM.AgentKeys = env.AgentKeys
+	}
+	envAllowSharedKey, _ := os.LookupEnv("ALLOW_SHARED_KEY")
+	if envAllowSharedKey == "" {
+		ArgsM.AllowSharedKey = FlagsServer.AllowSharedKey
+	} else {
+		ArgsM.AllowSharedKey = env.AllowSharedKey
+	}
+	envReplayWindow, _ := os.LookupEnv("REPLAY_WINDOW")
+	if envReplayWindow == "" {
+		ArgsM.ReplayWindow = FlagsServer.ReplayWindow
+	} else {
+		ArgsM.ReplayWindow = env.ReplayWindow
+	}
+	envNonceCacheSize, _ := os.LookupEnv("NONCE_CACHE_SIZE")
+	if envNonceCacheSize == "" {
+		ArgsM.NonceCacheSize = FlagsServer.NonceCacheSize
+	} else {
+		ArgsM.NonceCacheSize = env.NonceCacheSize
+	}
+	envRetryAttempts, _ := os.LookupEnv("RETRY_ATTEMPTS")
+	if envRetryAttempts == "" {
+		ArgsM.RetryAttempts = FlagsServer.RetryAttempts
+	} else {
+		ArgsM.RetryAttempts = env.RetryAttempts
+	}
+	envRetryBackoff, _ := os.LookupEnv("RETRY_BACKOFF")
+	if envRetryBackoff == "" {
+		ArgsM.RetryBackoff = FlagsServer.RetryBackoff
+	} else {
+		ArgsM.RetryBackoff = env.RetryBackoff
+	}
+	envSeriesLimit, _ := os.LookupEnv("SERIES_LIMIT")
+	if envSeriesLimit == "" {
+		ArgsM.SeriesLimit = FlagsServer.SeriesLimit
+	} else {
+		ArgsM.SeriesLimit = env.SeriesLimit
+	}
 
 	envFile, b := os.LookupEnv("STORE_FILE")
 
@@ -164,16 +347,75 @@ func TermEnvFlags() {
 // Var for unmarshal duration type
 type Duration time.Duration
 
+// Unmarshal duration from string like "10s" or number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
 // Parametrs enviroment for agent.
 type Config struct {
-	DatabaseDSN    string   `json:"database_dsn"`
-	CryptoKey      string   `json:"crypto_key"`
-	Address        string   `json:"address"`
-	StoreFile      string   `json:"store_file"`
-	Restore        bool     `json:"restore"`
-	StoreInterval  Duration `json:"store_interval"`
-	ReportInterval Duration `json:"report_interval"`
-	PollInterval   Duration `json:"poll_interval"`
+	DatabaseDSN     string    `json:"database_dsn"`
+	CryptoKey       string    `json:"crypto_key"`
+	Address         string    `json:"address"`
+	StoreFile       string    `json:"store_file"`
+	Storage         string    `json:"storage"`
+	HostLabel       string    `json:"host_label"`
+	StatsDAddress   string    `json:"statsd_address"`
+	GraphiteAddress string    `json:"graphite_address"`
+	GRPCAddress     string    `json:"grpc_address"`
+	Transport       string    `json:"transport"`
+	TrustedSubnet   string    `json:"trusted_subnet"`
+	Scheme          string    `json:"scheme"`
+	TLSCert         string    `json:"tls_cert"`
+	TLSKey          string    `json:"tls_key"`
+	TLSCA           string    `json:"tls_ca"`
+	AgentKeys       string    `json:"agent_keys"`
+	AgentID         string    `json:"agent_id"`
+	Restore         bool      `json:"restore"`
+	AllowSharedKey  bool      `json:"allow_shared_key"`
+	SeriesLimit     *int      `json:"series_limit"`
+	NonceCacheSize  *int      `json:"nonce_cache_size"`
+	RateLimit       *int      `json:"rate_limit"`
+	QueueDir        string    `json:"queue_dir"`
+	Collectors      *string   `json:"collectors"`
+	QueueMaxSize    *int      `json:"queue_max_size"`
+	QueueMaxAge     *Duration `json:"queue_max_age"`
+	RetryAttempts   *int      `json:"retry_attempts"`
+	RetryBackoff    *string   `json:"retry_backoff"`
+	ReplayWindow    Duration  `json:"replay_window"`
+	StoreInterval   Duration  `json:"store_interval"`
+	ReportInterval  Duration  `json:"report_interval"`
+	PollInterval    Duration  `json:"poll_interval"`
+}
+
+// Value is set by flag or environment variable, so value of config file is not applied.
+// Flags with non-zero default can not be checked by value.
+func isSet(flagName string, envName string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == flagName {
+			set = true
+		}
+	})
+	envValue, _ := os.LookupEnv(envName)
+	return set || envValue != ""
 }
 
 // Parse config.
@@ -200,6 +442,78 @@ func parseConfig(configPath string) error {
 	if ArgsM.StoreFile == "" {
 		ArgsM.StoreFile = config.StoreFile
 	}
+	if config.SeriesLimit != nil && !isSet("series-limit", "SERIES_LIMIT") {
+		ArgsM.SeriesLimit = *config.SeriesLimit
+	}
+	if ArgsM.AgentKeys == "" {
+		ArgsM.AgentKeys = config.AgentKeys
+	}
+	if ArgsM.AgentID == "" {
+		ArgsM.AgentID = config.AgentID
+	}
+	if !ArgsM.AllowSharedKey {
+		ArgsM.AllowSharedKey = config.AllowSharedKey
+	}
+	if ArgsM.ReplayWindow == 0 {
+		ArgsM.ReplayWindow = time.Duration(config.ReplayWindow)
+	}
+	if config.NonceCacheSize != nil && !isSet("nonce-cache-size", "NONCE_CACHE_SIZE") {
+		ArgsM.NonceCacheSize = *config.NonceCacheSize
+	}
+	if config.RateLimit != nil && !isSet("l", "RATE_LIMIT") {
+		ArgsM.RateLimit = *config.RateLimit
+	}
+	if ArgsM.QueueDir == "" {
+		ArgsM.QueueDir = config.QueueDir
+	}
+	if config.Collectors != nil && !isSet("collectors", "COLLECTORS") {
+		ArgsM.Collectors = *config.Collectors
+	}
+	if config.QueueMaxSize != nil && !isSet("queue-max-size", "QUEUE_MAX_SIZE") {
+		ArgsM.QueueMaxSize = *config.QueueMaxSize
+	}
+	if config.QueueMaxAge != nil && !isSet("queue-max-age", "QUEUE_MAX_AGE") {
+		ArgsM.QueueMaxAge = time.Duration(*config.QueueMaxAge)
+	}
+	if config.RetryAttempts != nil && !isSet("retry-attempts", "RETRY_ATTEMPTS") {
+		ArgsM.RetryAttempts = *config.RetryAttempts
+	}
+	if config.RetryBackoff != nil && !isSet("retry-backoff", "RETRY_BACKOFF") {
+		ArgsM.RetryBackoff = *config.RetryBackoff
+	}
+	if ArgsM.HostLabel == "" {
+		ArgsM.HostLabel = config.HostLabel
+	}
+	if ArgsM.Storage == "" {
+		ArgsM.Storage = config.Storage
+	}
+	if ArgsM.StatsDAddress == "" {
+		ArgsM.StatsDAddress = config.StatsDAddress
+	}
+	if ArgsM.GraphiteAddress == "" {
+		ArgsM.GraphiteAddress = config.GraphiteAddress
+	}
+	if ArgsM.GRPCAddress == "" {
+		ArgsM.GRPCAddress = config.GRPCAddress
+	}
+	if ArgsM.Transport == "" {
+		ArgsM.Transport = config.Transport
+	}
+	if ArgsM.TrustedSubnet == "" {
+		ArgsM.TrustedSubnet = config.TrustedSubnet
+	}
+	if ArgsM.Scheme == "" {
+		ArgsM.Scheme = config.Scheme
+	}
+	if ArgsM.TLSCert == "" {
+		ArgsM.TLSCert = config.TLSCert
+	}
+	if ArgsM.TLSKey == "" {
+		ArgsM.TLSKey = config.TLSKey
+	}
+	if ArgsM.TLSCA == "" {
+		ArgsM.TLSCA = config.TLSCA
+	}
 	return err
 }
 
@@ -212,6 +526,21 @@ func TermEnvFlagsAgent() {
 	flag.DurationVar(&FlagsAgent.ReportInterval, "r", 10000000000, "Report interval")
 	flag.DurationVar(&FlagsAgent.PollInterval, "p", 2000000000, "Poll interval")
 	flag.StringVar(&FlagsAgent.PubKey, "crypto-key", "", "Public key")
+	flag.StringVar(&FlagsAgent.HostLabel, "host-label", "", "Value of label host, hostname by default")
+	flag.StringVar(&FlagsAgent.Transport, "transport", "", "Transport of metrics: http, grpc or grpc-stream, http by default")
+	flag.StringVar(&FlagsAgent.GRPCAddress, "grpc-address", "", "Address of gRPC server")
+	flag.IntVar(&FlagsAgent.RateLimit, "l", 1, "Count of concurrent requests to server")
+	flag.StringVar(&FlagsAgent.Collectors, "collectors", "cpu,mem", "Comma-separated collectors of system metrics: cpu, mem, swap, load")
+	flag.StringVar(&FlagsAgent.QueueDir, "queue-dir", "", "Directory of queue of undelivered batches, batches are not kept if empty")
+	flag.IntVar(&FlagsAgent.QueueMaxSize, "queue-max-size", 64<<20, "Max size of queue in bytes, oldest batches are dropped")
+	flag.DurationVar(&FlagsAgent.QueueMaxAge, "queue-max-age", 24*time.Hour, "Max age of queued batches")
+	flag.StringVar(&FlagsAgent.AgentID, "agent-id", "", "ID of agent sent to server, server uses shared key if empty")
+	flag.StringVar(&FlagsAgent.Scheme, "scheme", "", "Scheme of server URL: http or https, http by default")
+	flag.StringVar(&FlagsAgent.TLSCA, "tls-ca", "", "CA bundle verifying server certificate, system roots by default")
+	flag.StringVar(&FlagsAgent.TLSCert, "tls-cert", "", "Client TLS certificate for mTLS")
+	flag.StringVar(&FlagsAgent.TLSKey, "tls-key", "", "Client TLS private key for mTLS")
+	flag.IntVar(&FlagsAgent.RetryAttempts, "retry-attempts", 4, "Count of attempts of sending report")
+	flag.StringVar(&FlagsAgent.RetryBackoff, "retry-backoff", "1s,3s,5s", "Comma-separated delays between attempts, last delay is repeated")
 	flag.Parse()
 
 	env := loadConfig()
@@ -247,6 +576,96 @@ func TermEnvFlagsAgent() {
 	} else {
 		ArgsM.Key = env.Key
 	}
+	envTransport, _ := os.LookupEnv("TRANSPORT")
+	if envTransport == "" {
+		ArgsM.Transport = FlagsAgent.Transport
+	} else {
+		ArgsM.Transport = env.Transport
+	}
+	envGRPCAddress, _ := os.LookupEnv("GRPC_ADDRESS")
+	if envGRPCAddress == "" {
+		ArgsM.GRPCAddress = FlagsAgent.GRPCAddress
+	} else {
+		ArgsM.GRPCAddress = env.GRPCAddress
+	}
+	envAgentID, _ := os.LookupEnv("AGENT_ID")
+	if envAgentID == "" {
+		ArgsM.AgentID = FlagsAgent.AgentID
+	} else {
+		ArgsM.AgentID = env.AgentID
+	}
+	envRateLimit, _ := os.LookupEnv("RATE_LIMIT")
+	if envRateLimit == "" {
+		ArgsM.RateLimit = FlagsAgent.RateLimit
+	} else {
+		ArgsM.RateLimit = env.RateLimit
+	}
+	envCollectors, _ := os.LookupEnv("COLLECTORS")
+	if envCollectors == "" {
+		ArgsM.Collectors = FlagsAgent.Collectors
+	} else {
+		ArgsM.Collectors = env.Collectors
+	}
+	envQueueDir, _ := os.LookupEnv("QUEUE_DIR")
+	if envQueueDir == "" {
+		ArgsM.QueueDir = FlagsAgent.QueueDir
+	} else {
+		ArgsM.QueueDir = env.QueueDir
+	}
+	envQueueMaxSize, _ := os.LookupEnv("QUEUE_MAX_SIZE")
+	if envQueueMaxSize == "" {
+		ArgsM.QueueMaxSize = FlagsAgent.QueueMaxSize
+	} else {
+		ArgsM.QueueMaxSize = env.QueueMaxSize
+	}
+	envQueueMaxAge, _ := os.LookupEnv("QUEUE_MAX_AGE")
+	if envQueueMaxAge == "" {
+		ArgsM.QueueMaxAge = FlagsAgent.QueueMaxAge
+	} else {
+		ArgsM.QueueMaxAge = env.QueueMaxAge
+	}
+	envRetryAttempts, _ := os.LookupEnv("RETRY_ATTEMPTS")
+	if envRetryAttempts == "" {
+		ArgsM.RetryAttempts = FlagsAgent.RetryAttempts
+	} else {
+		ArgsM.RetryAttempts = env.RetryAttempts
+	}
+	envRetryBackoff, _ := os.LookupEnv("RETRY_BACKOFF")
+	if envRetryBackoff == "" {
+		ArgsM.RetryBackoff = FlagsAgent.RetryBackoff
+	} else {
+		ArgsM.RetryBackoff = env.RetryBackoff
+	}
+	envScheme, _ := os.LookupEnv("SCHEME")
+	if envScheme == "" {
+		ArgsM.Scheme = FlagsAgent.Scheme
+	} else {
+		ArgsM.Scheme = env.Scheme
+	}
+	envTLSCA, _ := os.LookupEnv("TLS_CA")
+	if envTLSCA == "" {
+		ArgsM.TLSCA = FlagsAgent.TLSCA
+	} else {
+		ArgsM.TLSCA = env.TLSCA
+	}
+	envTLSCert, _ := os.LookupEnv("TLS_CERT")
+	if envTLSCert == "" {
+		ArgsM.TLSCert = FlagsAgent.TLSCert
+	} else {
+		ArgsM.TLSCert = env.TLSCert
+	}
+	envTLSKey, _ := os.LookupEnv("TLS_KEY")
+	if envTLSKey == "" {
+		ArgsM.TLSKey = FlagsAgent.TLSKey
+	} else {
+		ArgsM.TLSKey = env.TLSKey
+	}
+	envHostLabel, _ := os.LookupEnv("HOST_LABEL")
+	if envHostLabel == "" {
+		ArgsM.HostLabel = FlagsAgent.HostLabel
+	} else {
+		ArgsM.HostLabel = env.HostLabel
+	}
 	envConfig, _ := os.LookupEnv("CONFIG")
 	if envConfig != "" && FlagsAgent.Config == "" {
 		parseConfig(envConfig)
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"collectors":"swap","rate_limit":4,"series_limit":10,"nonce_cache_size":20,"queue_max_size":30,"queue_max_age":"1h","retry_attempts":2,"retry_backoff":"2s"}`), 0600))
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want Args
+	}{
+		{
+			name: "config file over default of flags",
+			want: Args{Collectors: "swap", RateLimit: 4, SeriesLimit: 10, NonceCacheSize: 20, QueueMaxSize: 30, QueueMaxAge: time.Hour, RetryAttempts: 2, RetryBackoff: "2s"},
+		},
+		{
+			name: "flags over config file",
+			args: []string{"-collectors=mem", "-l=2", "-series-limit=1000", "-queue-max-age=24h"},
+			want: Args{Collectors: "mem", RateLimit: 2, SeriesLimit: 1000, NonceCacheSize: 20, QueueMaxSize: 30, QueueMaxAge: 24 * time.Hour, RetryAttempts: 2, RetryBackoff: "2s"},
+		},
+		{
+			// config file does not override ArgsM when environment variable is set
+			name: "environment over config file",
+			env:  map[string]string{"COLLECTORS": "load", "NONCE_CACHE_SIZE": "100000", "QUEUE_MAX_SIZE": "64"},
+			want: Args{Collectors: "cpu,mem", RateLimit: 4, SeriesLimit: 10, NonceCacheSize: 100000, QueueMaxSize: 64 << 20, QueueMaxAge: time.Hour, RetryAttempts: 2, RetryBackoff: "2s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commandLine := flag.CommandLine
+			defer func() { flag.CommandLine = commandLine }()
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			var flags FlagsAg
+			flag.StringVar(&flags.Collectors, "collectors", "cpu,mem", "")
+			flag.IntVar(&flags.RateLimit, "l", 1, "")
+			flag.IntVar(&flags.QueueMaxSize, "queue-max-size", 64<<20, "")
+			flag.DurationVar(&flags.QueueMaxAge, "queue-max-age", 24*time.Hour, "")
+			var server FlagsServ
+			flag.IntVar(&server.SeriesLimit, "series-limit", 1000, "")
+			flag.IntVar(&server.NonceCacheSize, "nonce-cache-size", 100000, "")
+			require.NoError(t, flag.CommandLine.Parse(tt.args))
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			ArgsM = Args{
+				Collectors:     flags.Collectors,
+				RateLimit:      flags.RateLimit,
+				QueueMaxSize:   flags.QueueMaxSize,
+				QueueMaxAge:    flags.QueueMaxAge,
+				SeriesLimit:    server.SeriesLimit,
+				NonceCacheSize: server.NonceCacheSize,
+			}
+			defer func() { ArgsM = Args{} }()
+
+			require.NoError(t, parseConfig(path))
+			require.Equal(t, tt.want, ArgsM)
+		})
+	}
+}
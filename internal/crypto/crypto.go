@@ -1,83 +1,353 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// Envelope of hybrid encryption:
+// magic | version | length of key ID (byte) | key ID | length of wrapped key (uint16) | wrapped key | nonce | AES-GCM ciphertext.
+// Envelope of version 1 has no key ID. Data without magic is decrypted as legacy chunked RSA-OAEP.
+var magic = []byte("MENC")
+
+// Versions of envelope
+const (
+	envelopeV1 byte = 1
+	envelopeV2 byte = 2
+)
+
+// Size of key ID in bytes before hex encoding
+const keyIDSize = 8
+
+// Size of AES-256 key
+const aesKeySize = 32
+
+// Errors of encryption
+var (
+	ErrNotRSAKey         = errors.New("key is not RSA")
+	ErrInvalidKey        = errors.New("invalid key")
+	ErrInvalidEnvelope   = errors.New("invalid encrypted envelope")
+	ErrUnsupportedFormat = errors.New("unsupported version of encrypted envelope")
+	ErrUnknownKey        = errors.New("unknown key ID")
+	ErrNoKeys            = errors.New("no private keys")
+)
+
+// Private keys by key ID, all of them are accepted during rotation
+type Keyring map[string]*rsa.PrivateKey
+
+// Create keyring from private keys
+func NewKeyring(keys ...*rsa.PrivateKey) Keyring {
+	k := make(Keyring, len(keys))
+	for _, priv := range keys {
+		k[KeyID(&priv.PublicKey)] = priv
+	}
+	return k
+}
+
+// Load keyring from private key files separated by comma
+func LoadKeyring(paths string) (Keyring, error) {
+	var keys []*rsa.PrivateKey
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		pk, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := ParsePrivateKey(pk)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, priv)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return NewKeyring(keys...), nil
+}
+
+// ID of key, hex prefix of SHA-256 of public key in PKIX format
+func KeyID(pub *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:keyIDSize])
+}
+
+// Encrypt data by public key from file
 func EncryptData(data []byte, pubKey string) ([]byte, error) {
 	pk, err := os.ReadFile(pubKey)
 	if err != nil {
 		return nil, err
 	}
-	parsed, _, _, _, err := ssh.ParseAuthorizedKey(pk)
+	pub, err := ParsePublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	return Encrypt(data, pub)
+}
+
+// Decrypt data by private keys from files separated by comma
+func DecryptData(data []byte, privKeys string) ([]byte, error) {
+	k, err := LoadKeyring(privKeys)
 	if err != nil {
 		return nil, err
 	}
+	return k.Decrypt(data)
+}
 
-	parsedCryptoKey := parsed.(ssh.CryptoPublicKey)
-	pubCrypto := parsedCryptoKey.CryptoPublicKey()
+// Encrypt data by random AES-256-GCM key wrapped with RSA-OAEP
+func Encrypt(data []byte, pub *rsa.PublicKey) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, magic)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	id := KeyID(pub)
+	header := make([]byte, 0, len(magic)+4+len(id)+len(wrapped)+len(nonce))
+	header = append(header, magic...)
+	header = append(header, envelopeV2, byte(len(id)))
+	header = append(header, id...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, nonce...)
+	// header is authenticated, so it can not be changed without failing decryption
+	return gcm.Seal(header, nonce, data, header), nil
+}
 
-	pub := pubCrypto.(*rsa.PublicKey)
-	hash := sha256.New()
-	datalen := len(data)
-	step := pub.Size() - 2*hash.Size() - 2
+// Decrypt envelope or data of legacy format by private key
+func Decrypt(data []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	return NewKeyring(priv).Decrypt(data)
+}
 
-	var encryptedBytes []byte
-	for start := 0; start < datalen; start += step {
-		finish := start + step
-		if finish > datalen {
-			finish = datalen
+// Decrypt envelope by key with ID from envelope, envelope without key ID by any key
+func (k Keyring) Decrypt(data []byte) ([]byte, error) {
+	if len(k) == 0 {
+		return nil, ErrNoKeys
+	}
+	if !bytes.HasPrefix(data, magic) {
+		return k.try(data, decryptLegacy)
+	}
+	if len(data) < len(magic)+1 {
+		return nil, ErrInvalidEnvelope
+	}
+	pos := len(magic) + 1
+	switch version := data[len(magic)]; version {
+	case envelopeV1:
+		return k.try(data, func(data []byte, priv *rsa.PrivateKey) ([]byte, error) {
+			return openEnvelope(data, pos, priv)
+		})
+	case envelopeV2:
+		if len(data) < pos+1 || len(data) < pos+1+int(data[pos]) {
+			return nil, ErrInvalidEnvelope
 		}
-		var encryptedBlock []byte
-		encryptedBlock, err = rsa.EncryptOAEP(hash, rand.Reader, pub, data[start:finish], nil)
-		if err != nil {
-			return nil, err
+		id := string(data[pos+1 : pos+1+int(data[pos])])
+		priv, ok := k[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
 		}
-		encryptedBytes = append(encryptedBytes, encryptedBlock...)
+		return openEnvelope(data, pos+1+len(id), priv)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedFormat, version)
 	}
-	return encryptedBytes, err
 }
 
-//decrypt data
-func DecryptData(data []byte, privKey string) ([]byte, error) {
-	pk, err := os.ReadFile(privKey)
+// Decrypt data by every key until success
+func (k Keyring) try(data []byte, decrypt func([]byte, *rsa.PrivateKey) ([]byte, error)) ([]byte, error) {
+	ids := make([]string, 0, len(k))
+	for id := range k {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var err error
+	for _, id := range ids {
+		var decrypted []byte
+		decrypted, err = decrypt(data, k[id])
+		if err == nil {
+			return decrypted, nil
+		}
+	}
+	return nil, err
+}
+
+// Decrypt envelope from position of wrapped key length
+func openEnvelope(data []byte, pos int, priv *rsa.PrivateKey) ([]byte, error) {
+	if len(data) < pos+2 {
+		return nil, ErrInvalidEnvelope
+	}
+	keyLen := int(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+	if len(data) < pos+keyLen {
+		return nil, ErrInvalidEnvelope
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data[pos:pos+keyLen], magic)
 	if err != nil {
 		return nil, err
 	}
-	pem, _ := pem.Decode(pk)
-
-	rsaPriv, err := x509.ParsePKCS8PrivateKey(pem.Bytes)
+	pos += keyLen
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
+	if len(data) < pos+gcm.NonceSize() {
+		return nil, ErrInvalidEnvelope
+	}
+	nonce := data[pos : pos+gcm.NonceSize()]
+	pos += gcm.NonceSize()
+	return gcm.Open(nil, nonce, data[pos:], data[:pos])
+}
+
+// Decrypt data encrypted by RSA-OAEP in blocks of key size
+func decryptLegacy(data []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	step := priv.Size()
+	if len(data)%step != 0 {
+		return nil, ErrInvalidEnvelope
+	}
+	var decrypted []byte
+	for start := 0; start < len(data); start += step {
+		block, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data[start:start+step], nil)
+		if err != nil {
+			return nil, err
+		}
+		decrypted = append(decrypted, block...)
+	}
+	return decrypted, nil
+}
 
-	if rsaPriv == nil {
-		return nil, errors.New("nil private key")
+// Create AES-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
-	hash := sha256.New()
-	key := rsaPriv.(*rsa.PrivateKey)
-	dataLen := len(data)
-	step := 384
-	var decryptedBytes []byte
-	for start := 0; start < dataLen; start += step {
-		finish := start + step
-		if finish > dataLen {
-			finish = dataLen
+	return cipher.NewGCM(block)
+}
+
+// Parse RSA public key in authorized_keys or PEM format
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
 		}
-		var decryptedBlock []byte
-		decryptedBlock, err = rsa.DecryptOAEP(hash, rand.Reader, key, data[start:finish], nil)
 		if err != nil {
 			return nil, err
 		}
-		decryptedBytes = append(decryptedBytes, decryptedBlock...)
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, ErrNotRSAKey
+		}
+		return pub, nil
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cryptoKey, ok := parsed.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, ErrNotRSAKey
+	}
+	pub, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrNotRSAKey
+	}
+	return pub, nil
+}
+
+// Parse RSA private key in PEM format, PKCS8 or PKCS1
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrNotRSAKey
+	}
+	return priv, nil
+}
+
+// Generate RSA key pair and write private key in PEM PKCS8 to path and public key
+// in authorized_keys format to path.pub, existing files are not overwritten
+func GenerateKeyFiles(path string, bits int) (string, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	err = writeNew(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return "", err
+	}
+	err = writeNew(path+".pub", ssh.MarshalAuthorizedKey(pub), 0644)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return KeyID(&priv.PublicKey), nil
+}
+
+// Write data to file which must not exist
+func writeNew(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
 	}
-	return decryptedBytes, err
+	return f.Close()
 }
@@ -0,0 +1,339 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// Write key pair to files, public key in authorized_keys format
+func writeKeys(t *testing.T, priv *rsa.PrivateKey) (string, string) {
+	dir := t.TempDir()
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	privPath := filepath.Join(dir, "key")
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pubPath := filepath.Join(dir, "key.pub")
+	require.NoError(t, os.WriteFile(pubPath, ssh.MarshalAuthorizedKey(pub), 0600))
+	return privPath, pubPath
+}
+
+// Encrypt data in legacy format by RSA-OAEP blocks
+func encryptLegacy(t *testing.T, data []byte, pub *rsa.PublicKey) []byte {
+	step := pub.Size() - 2*sha256.Size - 2
+	var encrypted []byte
+	for start := 0; start < len(data); start += step {
+		finish := start + step
+		if finish > len(data) {
+			finish = len(data)
+		}
+		block, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data[start:finish], nil)
+		require.NoError(t, err)
+		encrypted = append(encrypted, block...)
+	}
+	return encrypted
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	data := make([]byte, 10000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	for _, bits := range []int{1024, 2048, 3072} {
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		require.NoError(t, err)
+		privPath, pubPath := writeKeys(t, priv)
+
+		encrypted, err := EncryptData(data, pubPath)
+		require.NoError(t, err)
+		require.Equal(t, magic, encrypted[:len(magic)])
+		decrypted, err := DecryptData(encrypted, privPath)
+		require.NoError(t, err)
+		require.Equal(t, data, decrypted)
+
+		decrypted, err = Decrypt(encryptLegacy(t, data, &priv.PublicKey), priv)
+		require.NoError(t, err)
+		require.Equal(t, data, decrypted)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encrypted, err := Encrypt([]byte("metrics"), &priv.PublicKey)
+	require.NoError(t, err)
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = Decrypt(tampered, priv)
+	require.Error(t, err)
+
+	version := append([]byte(nil), encrypted...)
+	version[len(magic)] = 99
+	_, err = Decrypt(version, priv)
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	_, err = Decrypt(encrypted[:len(magic)+10], priv)
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	_, err = Decrypt([]byte("not encrypted"), priv)
+	require.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = Decrypt(encrypted, other)
+	require.Error(t, err)
+}
+
+func TestParseKeys(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "PKIX", data: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})},
+		{name: "PKCS1", data: pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&priv.PublicKey)})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := ParsePublicKey(tt.data)
+			require.NoError(t, err)
+			require.True(t, pub.Equal(&priv.PublicKey))
+		})
+	}
+	parsed, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}))
+	require.NoError(t, err)
+	require.True(t, parsed.Equal(priv))
+	_, err = ParsePrivateKey([]byte("not a key"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+// Encrypt data in envelope of version 1 without key ID
+func encryptV1(t *testing.T, data []byte, pub *rsa.PublicKey) []byte {
+	key := make([]byte, aesKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, magic)
+	require.NoError(t, err)
+	gcm, err := newGCM(key)
+	require.NoError(t, err)
+	nonce := make([]byte, gcm.NonceSize())
+	header := append(append([]byte(nil), magic...), envelopeV1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(append(header, wrapped...), nonce...)
+	return gcm.Seal(header, nonce, data, header)
+}
+
+func TestKeyring(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	unknown, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	k := NewKeyring(oldKey, newKey)
+	require.Len(t, k, 2)
+
+	data := []byte("metrics")
+	for _, priv := range []*rsa.PrivateKey{oldKey, newKey} {
+		encrypted, err := Encrypt(data, &priv.PublicKey)
+		require.NoError(t, err)
+		require.Equal(t, envelopeV2, encrypted[len(magic)])
+		require.Equal(t, KeyID(&priv.PublicKey), string(encrypted[len(magic)+2:len(magic)+2+2*keyIDSize]))
+		for _, encrypted := range [][]byte{encrypted, encryptV1(t, data, &priv.PublicKey), encryptLegacy(t, data, &priv.PublicKey)} {
+			decrypted, err := k.Decrypt(encrypted)
+			require.NoError(t, err)
+			require.Equal(t, data, decrypted)
+		}
+	}
+
+	encrypted, err := Encrypt(data, &unknown.PublicKey)
+	require.NoError(t, err)
+	_, err = k.Decrypt(encrypted)
+	require.ErrorIs(t, err, ErrUnknownKey)
+	_, err = k.Decrypt(encryptV1(t, data, &unknown.PublicKey))
+	require.Error(t, err)
+	_, err = Keyring{}.Decrypt(encrypted)
+	require.ErrorIs(t, err, ErrNoKeys)
+}
+
+func TestGenerateKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	oldID, err := GenerateKeyFiles(oldPath, 1024)
+	require.NoError(t, err)
+	newID, err := GenerateKeyFiles(newPath, 2048)
+	require.NoError(t, err)
+	require.NotEqual(t, oldID, newID)
+
+	_, err = GenerateKeyFiles(oldPath, 1024)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	k, err := LoadKeyring(oldPath + ", " + newPath)
+	require.NoError(t, err)
+	require.Contains(t, k, oldID)
+	require.Contains(t, k, newID)
+	for _, path := range []string{oldPath, newPath} {
+		encrypted, err := EncryptData([]byte("metrics"), path+".pub")
+		require.NoError(t, err)
+		decrypted, err := DecryptData(encrypted, oldPath+","+newPath)
+		require.NoError(t, err)
+		require.Equal(t, []byte("metrics"), decrypted)
+	}
+
+	_, err = LoadKeyring("")
+	require.ErrorIs(t, err, ErrNoKeys)
+	_, err = LoadKeyring(oldPath + ".pub")
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestReloadKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key")
+	_, err := GenerateKeyFiles(path, 1024)
+	require.NoError(t, err)
+	e, err := NewEncrypter(path + ".pub")
+	require.NoError(t, err)
+	d, err := NewDecrypter(path)
+	require.NoError(t, err)
+	encrypted, err := e.Encrypt([]byte("metrics"))
+	require.NoError(t, err)
+	decrypted, err := d.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, []byte("metrics"), decrypted)
+
+	// rotate keys in place, old data is rejected after reload
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Remove(path+".pub"))
+	_, err = GenerateKeyFiles(path, 1024)
+	require.NoError(t, err)
+	require.NoError(t, e.Reload())
+	require.NoError(t, d.Reload())
+	_, err = d.Decrypt(encrypted)
+	require.ErrorIs(t, err, ErrUnknownKey)
+	encrypted, err = e.Encrypt([]byte("metrics"))
+	require.NoError(t, err)
+	decrypted, err = d.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, []byte("metrics"), decrypted)
+
+	// broken file does not replace loaded keys
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0600))
+	require.Error(t, d.Reload())
+	_, err = d.Decrypt(encrypted)
+	require.NoError(t, err)
+
+	_, err = NewDecrypter(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+	_, err = NewEncrypter(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+// Write certificate signed by parent and its key to files in dir, self-signed if parent is nil
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, priv
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, priv
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "metrics CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "agent", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverCfg, err := ServerTLSConfig(path("server.crt"), path("server.key"), path("ca.crt"))
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = serverCfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		ca      string
+		cert    string
+		key     string
+		wantErr bool
+	}{
+		{name: "client certificate", ca: path("ca.crt"), cert: path("agent.crt"), key: path("agent.key")},
+		{name: "without client certificate", ca: path("ca.crt"), wantErr: true},
+		{name: "unknown server", cert: path("agent.crt"), key: path("agent.key"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := ClientTLSConfig(tt.ca, tt.cert, tt.key)
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			resp, err := client.Get(ts.URL)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+
+	_, err = ServerTLSConfig(path("server.crt"), path("server.key"), path("server.key"))
+	require.ErrorIs(t, err, ErrNoCertificates)
+	_, err = ClientTLSConfig("", path("agent.crt"), "")
+	require.Error(t, err)
+}
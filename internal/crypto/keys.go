@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"os"
+	"sync"
+)
+
+// Private keys parsed once from files and reloaded on demand
+type Decrypter struct {
+	paths   string
+	mu      sync.RWMutex
+	keyring Keyring
+}
+
+// Load private keys from files separated by comma
+func NewDecrypter(paths string) (*Decrypter, error) {
+	d := &Decrypter{paths: paths}
+	err := d.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Read private keys from files again, current keys are kept on error
+func (d *Decrypter) Reload() error {
+	k, err := LoadKeyring(d.paths)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.keyring = k
+	d.mu.Unlock()
+	return nil
+}
+
+// Decrypt data by loaded keys
+func (d *Decrypter) Decrypt(data []byte) ([]byte, error) {
+	d.mu.RLock()
+	k := d.keyring
+	d.mu.RUnlock()
+	return k.Decrypt(data)
+}
+
+// Public key parsed once from file and reloaded on demand
+type Encrypter struct {
+	path string
+	mu   sync.RWMutex
+	pub  *rsa.PublicKey
+}
+
+// Load public key from file
+func NewEncrypter(path string) (*Encrypter, error) {
+	e := &Encrypter{path: path}
+	err := e.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Read public key from file again, current key is kept on error
+func (e *Encrypter) Reload() error {
+	pk, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	pub, err := ParsePublicKey(pk)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.pub = pub
+	e.mu.Unlock()
+	return nil
+}
+
+// Encrypt data by loaded key
+func (e *Encrypter) Encrypt(data []byte) ([]byte, error) {
+	e.mu.RLock()
+	pub := e.pub
+	e.mu.RUnlock()
+	return Encrypt(data, pub)
+}
@@ -0,0 +1,50 @@
+package proto
+
+import (
+	protobuf "google.golang.org/protobuf/proto"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// Bytes of metrics signed against replay, metrics of stream are signed as one request
+func SignedBody(metrics []*Metric) ([]byte, error) {
+	return protobuf.MarshalOptions{Deterministic: true}.Marshal(&UpdateMetricsRequest{Metrics: metrics})
+}
+
+// Convert metric of JSON format to protobuf
+func FromJSON(m storage.JSONMetrics) *Metric {
+	p := &Metric{
+		Id:           m.ID,
+		Type:         m.MType,
+		Delta:        m.Delta,
+		Value:        m.Value,
+		Labels:       m.Labels,
+		Sum:          m.Sum,
+		Count:        m.Count,
+		Observations: m.Observations,
+		Hash:         m.Hash,
+	}
+	for _, b := range m.Buckets {
+		p.Buckets = append(p.Buckets, &Bucket{Le: b.UpperBound, Count: b.Count})
+	}
+	return p
+}
+
+// Convert metric of protobuf to JSON format
+func (p *Metric) JSON() storage.JSONMetrics {
+	m := storage.JSONMetrics{
+		ID:           p.GetId(),
+		MType:        p.GetType(),
+		Delta:        p.Delta,
+		Value:        p.Value,
+		Labels:       p.GetLabels(),
+		Sum:          p.Sum,
+		Count:        p.Count,
+		Observations: p.GetObservations(),
+		Hash:         p.GetHash(),
+	}
+	for _, b := range p.GetBuckets() {
+		m.Buckets = append(m.Buckets, storage.Bucket{UpperBound: b.GetLe(), Count: b.GetCount()})
+	}
+	return m
+}
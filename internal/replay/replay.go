@@ -0,0 +1,158 @@
+package replay
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of signed batch
+const (
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Replay-Signature"
+)
+
+// Metadata keys of signed gRPC call
+const (
+	MetadataTimestamp = "x-timestamp"
+	MetadataNonce     = "x-nonce"
+	MetadataSignature = "x-replay-signature"
+)
+
+// Size of nonce in bytes before hex encoding
+const nonceSize = 16
+
+// Errors of checking batch
+var (
+	ErrMissing   = errors.New("timestamp, nonce or signature is missing")
+	ErrSignature = errors.New("invalid replay signature")
+	ErrStale     = errors.New("timestamp is out of window")
+	ErrDuplicate = errors.New("nonce is already used")
+	ErrCacheSize = errors.New("size of nonce cache must be positive")
+)
+
+// Random nonce in hex
+func NewNonce() (string, error) {
+	b := make([]byte, nonceSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HMAC-SHA256 of timestamp, nonce and SHA-256 of body in hex
+func Sign(key []byte, timestamp int64, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%d:%s:%x", timestamp, nonce, sum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Check signature of headers values, timestamp is unix time in seconds
+func Verify(key []byte, timestamp, nonce, signature string, body []byte) (time.Time, error) {
+	if timestamp == "" || nonce == "" || signature == "" {
+		return time.Time{}, ErrMissing
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: timestamp %q", ErrMissing, timestamp)
+	}
+	if !hmac.Equal([]byte(Sign(key, ts, nonce, body)), []byte(signature)) {
+		return time.Time{}, ErrSignature
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// Guard rejects timestamps out of window and nonces seen before, it keeps at most size nonces
+type Guard struct {
+	window time.Duration
+	size   int
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	queue  nonceHeap
+	// timestamps not after evicted ones are rejected, nonces of them are forgotten
+	evicted time.Time
+}
+
+// Create guard with window of accepted timestamps and size of nonce cache, size must be positive
+func NewGuard(window time.Duration, size int) (*Guard, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("%w: %d", ErrCacheSize, size)
+	}
+	return &Guard{
+		window: window,
+		size:   size,
+		seen:   make(map[string]struct{}),
+	}, nil
+}
+
+// Check timestamp and remember nonce, now is current time of server
+func (g *Guard) Check(ts time.Time, nonce string, now time.Time) error {
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return ErrStale
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for len(g.queue) > 0 && g.queue[0].ts.Before(now.Add(-g.window)) {
+		g.evict()
+	}
+	if !ts.After(g.evicted) {
+		return ErrStale
+	}
+	if _, ok := g.seen[nonce]; ok {
+		return ErrDuplicate
+	}
+	if len(g.queue) >= g.size {
+		g.evict()
+		if !ts.After(g.evicted) {
+			return ErrStale
+		}
+	}
+	g.seen[nonce] = struct{}{}
+	heap.Push(&g.queue, entry{ts: ts, nonce: nonce})
+	return nil
+}
+
+// Count of remembered nonces
+func (g *Guard) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.queue)
+}
+
+// Forget nonce with oldest timestamp
+func (g *Guard) evict() {
+	e := heap.Pop(&g.queue).(entry)
+	delete(g.seen, e.nonce)
+	if e.ts.After(g.evicted) {
+		g.evicted = e.ts
+	}
+}
+
+type entry struct {
+	ts    time.Time
+	nonce string
+}
+
+// Min-heap of nonces by timestamp
+type nonceHeap []entry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].ts.Before(h[j].ts) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(entry)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,82 @@
+package replay
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	key := []byte("key")
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	sig := Sign(key, 100, "abc", body)
+	tests := []struct {
+		name      string
+		timestamp string
+		nonce     string
+		signature string
+		body      []byte
+		wantErr   error
+	}{
+		{name: "valid", timestamp: "100", nonce: "abc", signature: sig, body: body},
+		{name: "missing nonce", timestamp: "100", signature: sig, body: body, wantErr: ErrMissing},
+		{name: "bad timestamp", timestamp: "now", nonce: "abc", signature: sig, body: body, wantErr: ErrMissing},
+		{name: "changed timestamp", timestamp: "101", nonce: "abc", signature: sig, body: body, wantErr: ErrSignature},
+		{name: "changed nonce", timestamp: "100", nonce: "abd", signature: sig, body: body, wantErr: ErrSignature},
+		{name: "changed body", timestamp: "100", nonce: "abc", signature: sig, body: []byte("[]"), wantErr: ErrSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := Verify(key, tt.timestamp, tt.nonce, tt.signature, tt.body)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, time.Unix(100, 0), ts)
+		})
+	}
+}
+
+func TestGuard(t *testing.T) {
+	now := time.Unix(1000, 0)
+	g, err := NewGuard(time.Minute, 3)
+	require.NoError(t, err)
+	require.NoError(t, g.Check(now, "a", now))
+	require.ErrorIs(t, g.Check(now, "a", now), ErrDuplicate)
+	require.ErrorIs(t, g.Check(now.Add(-2*time.Minute), "b", now), ErrStale)
+	require.ErrorIs(t, g.Check(now.Add(2*time.Minute), "b", now), ErrStale)
+	require.NoError(t, g.Check(now.Add(-30*time.Second), "b", now))
+	require.NoError(t, g.Check(now.Add(time.Second), "c", now))
+
+	// full cache forgets oldest nonce and rejects timestamps not after it
+	require.NoError(t, g.Check(now.Add(2*time.Second), "d", now))
+	require.Equal(t, 3, g.Len())
+	require.ErrorIs(t, g.Check(now.Add(-30*time.Second), "b", now), ErrStale)
+	require.ErrorIs(t, g.Check(now.Add(-time.Second), "e", now), ErrStale)
+
+	// expired nonces are removed
+	later := now.Add(2 * time.Minute)
+	require.NoError(t, g.Check(later, "a", later))
+	require.Equal(t, 1, g.Len())
+}
+
+func TestNewGuardSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		_, err := NewGuard(time.Minute, size)
+		require.ErrorIs(t, err, ErrCacheSize)
+	}
+}
+
+func TestNewNonce(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		n, err := NewNonce()
+		require.NoError(t, err)
+		require.Len(t, n, 2*nonceSize)
+		require.False(t, seen[n], strconv.Itoa(i))
+		seen[n] = true
+	}
+}
@@ -0,0 +1,129 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// Policy of retries, operation is tried Attempts times with Backoff delays between tries,
+// last delay is repeated if there are more retries than delays
+type Policy struct {
+	Attempts int
+	Backoff  []time.Duration
+}
+
+// Policy used by agent and database if it is not configured, three retries after 1s, 3s and 5s
+var Default = Policy{
+	Attempts: 4,
+	Backoff:  []time.Duration{time.Second, 3 * time.Second, 5 * time.Second},
+}
+
+// Create policy from config, backoff is comma-separated list of delays like "1s,3s,5s"
+func NewPolicy(attempts int, backoff string) (Policy, error) {
+	if attempts < 1 {
+		return Policy{}, fmt.Errorf("count of attempts must be positive: %d", attempts)
+	}
+	p := Policy{Attempts: attempts}
+	for _, s := range strings.Split(backoff, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid backoff %q: %w", s, err)
+		}
+		if d < 0 {
+			return Policy{}, fmt.Errorf("negative backoff %q", s)
+		}
+		p.Backoff = append(p.Backoff, d)
+	}
+	return p, nil
+}
+
+// Error marked as retriable by caller
+type retriableError struct {
+	err error
+}
+
+func (e *retriableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retriableError) Unwrap() error {
+	return e.err
+}
+
+// Mark error as retriable, used for errors which can not be classified by type, like HTTP statuses
+func Retriable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retriableError{err: err}
+}
+
+// Delay before retry after attempt, attempts are counted from 1
+func (p Policy) delay(attempt int) time.Duration {
+	if len(p.Backoff) == 0 {
+		return 0
+	}
+	if attempt > len(p.Backoff) {
+		attempt = len(p.Backoff)
+	}
+	return p.Backoff[attempt-1]
+}
+
+// Run fn until it succeeds, returns not retriable error or attempts are over, error of last attempt is returned
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !IsRetriable(err) || attempt >= p.Attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.delay(attempt)):
+		}
+	}
+}
+
+// Check that error is temporary and operation was not done, so it can be repeated without applying it twice:
+// errors of dial, errors of Postgres which roll transaction back and errors marked by Retriable.
+// Errors after request is sent, like reset connection or timeout of response, are not retried
+func IsRetriable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var re *retriableError
+	if errors.As(err, &re) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgerrcode.IsTransactionRollback(pgErr.Code) ||
+			pgErr.Code == pgerrcode.TooManyConnections ||
+			pgErr.Code == pgerrcode.AdminShutdown ||
+			pgErr.Code == pgerrcode.CrashShutdown ||
+			pgErr.Code == pgerrcode.CannotConnectNow
+	}
+	// nothing is sent to Postgres
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,121 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	temporary := Retriable(errors.New("temporary"))
+	permanent := errors.New("permanent")
+	policy := Policy{Attempts: 4, Backoff: []time.Duration{time.Millisecond, 2 * time.Millisecond}}
+	tests := []struct {
+		name         string
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "success", errs: []error{nil}, wantAttempts: 1},
+		{name: "success after retries", errs: []error{temporary, temporary, nil}, wantAttempts: 3},
+		{name: "not retriable", errs: []error{permanent}, wantErr: permanent, wantAttempts: 1},
+		{name: "attempts are over", errs: []error{temporary, temporary, temporary, temporary, nil}, wantErr: temporary, wantAttempts: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := policy.Do(context.Background(), func() error {
+				attempts++
+				return tt.errs[attempts-1]
+			})
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.wantAttempts, attempts)
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := Default.Do(ctx, func() error {
+		attempts++
+		cancel()
+		return Retriable(errors.New("temporary"))
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+}
+
+func TestDelay(t *testing.T) {
+	require.Equal(t, time.Second, Default.delay(1))
+	require.Equal(t, 3*time.Second, Default.delay(2))
+	require.Equal(t, 5*time.Second, Default.delay(3))
+	require.Equal(t, 5*time.Second, Default.delay(10))
+	require.Equal(t, time.Duration(0), Policy{Attempts: 2}.delay(1))
+}
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		backoff  string
+		want     Policy
+		wantErr  bool
+	}{
+		{name: "default", attempts: 4, backoff: "1s,3s,5s", want: Default},
+		{name: "spaces", attempts: 2, backoff: "100ms, 2s", want: Policy{Attempts: 2, Backoff: []time.Duration{100 * time.Millisecond, 2 * time.Second}}},
+		{name: "without backoff", attempts: 3, want: Policy{Attempts: 3}},
+		{name: "zero attempts", attempts: 0, backoff: "1s", wantErr: true},
+		{name: "invalid backoff", attempts: 2, backoff: "1s,soon", wantErr: true},
+		{name: "negative backoff", attempts: 2, backoff: "-1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPolicy(tt.attempts, tt.backoff)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, p)
+		})
+	}
+}
+
+func TestIsRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "marked", err: fmt.Errorf("send: %w", Retriable(errors.New("503"))), want: true},
+		{name: "other", err: errors.New("invalid metric"), want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "dial timeout", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}, want: true},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: false},
+		{name: "read of response", err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, want: false},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, want: false},
+		{name: "postgres connection failure", err: &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, want: true},
+		{name: "postgres serialization failure", err: &pgconn.PgError{Code: pgerrcode.SerializationFailure}, want: true},
+		{name: "postgres deadlock", err: &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, want: true},
+		{name: "postgres cannot connect now", err: &pgconn.PgError{Code: pgerrcode.CannotConnectNow}, want: true},
+		{name: "postgres unique violation", err: &pgconn.PgError{Code: pgerrcode.UniqueViolation}, want: false},
+		{name: "postgres invalid password", err: &pgconn.PgError{Code: pgerrcode.InvalidPassword}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IsRetriable(tt.err))
+		})
+	}
+}
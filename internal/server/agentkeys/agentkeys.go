@@ -0,0 +1,112 @@
+package agentkeys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Header and gRPC metadata with ID of agent
+const (
+	HeaderAgentID   = "X-Agent-ID"
+	MetadataAgentID = "x-agent-id"
+)
+
+// Errors of getting key of agent
+var (
+	ErrUnknownAgent = errors.New("unknown agent")
+	ErrRevoked      = errors.New("key of agent is revoked")
+)
+
+// Registry of keys of agents
+type Registry interface {
+	// Get key of agent, error if agent is unknown or revoked
+	Key(ctx context.Context, agentID string) (string, error)
+}
+
+// Key of agent in registry file
+type Agent struct {
+	Key     string `json:"key"`
+	Revoked bool   `json:"revoked"`
+}
+
+// Registry in JSON file mapping agent IDs to keys, reloaded on demand
+type FileRegistry struct {
+	path   string
+	mu     sync.RWMutex
+	agents map[string]Agent
+}
+
+// Load registry from JSON file
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	r := &FileRegistry{path: path}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Read registry file again, current keys are kept on error
+func (r *FileRegistry) Reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var agents map[string]Agent
+	err = json.Unmarshal(data, &agents)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.agents = agents
+	r.mu.Unlock()
+	return nil
+}
+
+// Get key of agent
+func (r *FileRegistry) Key(_ context.Context, agentID string) (string, error) {
+	r.mu.RLock()
+	a, ok := r.agents[agentID]
+	r.mu.RUnlock()
+	return checkAgent(a, ok)
+}
+
+// Registry in table agent_keys, revocation takes effect on next request
+type PostgresRegistry struct {
+	conn *pgxpool.Pool
+}
+
+// Create registry in database migrated by storage
+func NewPostgresRegistry(conn *pgxpool.Pool) *PostgresRegistry {
+	return &PostgresRegistry{conn: conn}
+}
+
+// Get key of agent
+func (r *PostgresRegistry) Key(ctx context.Context, agentID string) (string, error) {
+	var a Agent
+	err := r.conn.QueryRow(ctx, "SELECT key, revoked FROM agent_keys WHERE agent_id = $1", agentID).Scan(&a.Key, &a.Revoked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrUnknownAgent
+	}
+	if err != nil {
+		return "", err
+	}
+	return checkAgent(a, true)
+}
+
+// Key of found agent which is not revoked
+func checkAgent(a Agent, ok bool) (string, error) {
+	if !ok || a.Key == "" {
+		return "", ErrUnknownAgent
+	}
+	if a.Revoked {
+		return "", ErrRevoked
+	}
+	return a.Key, nil
+}
@@ -0,0 +1,57 @@
+package agentkeys
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"agent-1":{"key":"k1"},"agent-2":{"key":"k2","revoked":true},"agent-3":{}}`), 0600))
+	r, err := NewFileRegistry(path)
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		agentID string
+		want    string
+		wantErr error
+	}{
+		{name: "known", agentID: "agent-1", want: "k1"},
+		{name: "revoked", agentID: "agent-2", wantErr: ErrRevoked},
+		{name: "without key", agentID: "agent-3", wantErr: ErrUnknownAgent},
+		{name: "unknown", agentID: "agent-4", wantErr: ErrUnknownAgent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := r.Key(context.Background(), tt.agentID)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, key)
+		})
+	}
+
+	// revoke agent-1 without changing key of others
+	require.NoError(t, os.WriteFile(path, []byte(`{"agent-1":{"key":"k1","revoked":true},"agent-2":{"key":"k2"}}`), 0600))
+	require.NoError(t, r.Reload())
+	_, err = r.Key(context.Background(), "agent-1")
+	require.ErrorIs(t, err, ErrRevoked)
+	key, err := r.Key(context.Background(), "agent-2")
+	require.NoError(t, err)
+	require.Equal(t, "k2", key)
+
+	// broken file keeps loaded keys
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0600))
+	require.Error(t, r.Reload())
+	_, err = r.Key(context.Background(), "agent-2")
+	require.NoError(t, err)
+
+	_, err = NewFileRegistry(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
@@ -5,19 +5,23 @@ import (
 
 	"github.com/jackc/pgx/v4/pgxpool"
 	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/retry"
 )
 
-// Connect to database via DBURL
-func Connect(ctx context.Context, logger *zap.Logger, DBURL string) (Conn *pgxpool.Pool, err error) {
+// Connect to database via DBURL, temporary errors of connection are retried by policy
+func Connect(ctx context.Context, logger *zap.Logger, DBURL string, policy retry.Policy) (Conn *pgxpool.Pool, err error) {
 	cfgURL, err := pgxpool.ParseConfig(DBURL)
 	if err != nil {
 		logger.Error("Error parsing URL: ", zap.Error(err))
-		panic(err)
-	}
-	Conn, err = pgxpool.ConnectConfig(ctx, cfgURL)
-	if err != nil {
-		logger.Panic("Error connect ot database: ", zap.Error(err))
-		panic(err)
+		return nil, err
 	}
+	err = policy.Do(ctx, func() error {
+		Conn, err = pgxpool.ConnectConfig(ctx, cfgURL)
+		if err != nil {
+			logger.Error("Error connect to database: ", zap.Error(err))
+		}
+		return err
+	})
 	return Conn, err
 }
@@ -0,0 +1,129 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// Error of parsing Graphite line
+var ErrInvalidLine = errors.New("invalid graphite line")
+
+// Metric of Graphite plaintext protocol
+type Metric struct {
+	Path      string
+	Value     float64
+	Timestamp int64
+	Labels    map[string]string
+}
+
+// Listen TCP address and save metrics in storage until context is done
+func ListenAndServe(ctx context.Context, addr string, s storage.Storage, logger *zap.Logger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("Graphite listener started", zap.String("address", l.Addr().String()))
+	return Serve(ctx, l, s, logger)
+}
+
+// Accept connections and save metrics in storage until context is done
+func Serve(ctx context.Context, l net.Listener, s storage.Storage, logger *zap.Logger) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go handleConn(ctx, conn, s, logger)
+	}
+}
+
+// Read lines from connection until it is closed
+func handleConn(ctx context.Context, conn net.Conn, s storage.Storage, logger *zap.Logger) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		err := SaveLine(s, line)
+		if err != nil {
+			logger.Error("Error saving graphite metric: ", zap.String("line", line), zap.Error(err))
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		logger.Error("Error reading graphite connection: ", zap.Error(err))
+	}
+}
+
+// Parse line and save metric as gauge in storage
+func SaveLine(s storage.Storage, line string) error {
+	m, err := ParseLine(line)
+	if err != nil {
+		return err
+	}
+	return s.UpdateGauge(storage.MetricKey(m.Path, m.Labels), m.Value)
+}
+
+// Parse line of Graphite protocol path[;tag=value...] value [timestamp]
+func ParseLine(line string) (Metric, error) {
+	var m Metric
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return m, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+	path := strings.Split(fields[0], ";")
+	m.Path = path[0]
+	if m.Path == "" {
+		return m, fmt.Errorf("%w: empty path", ErrInvalidLine)
+	}
+	for _, tag := range path[1:] {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok || name == "" {
+			return m, fmt.Errorf("%w: tag %q", ErrInvalidLine, tag)
+		}
+		if m.Labels == nil {
+			m.Labels = make(map[string]string)
+		}
+		m.Labels[name] = value
+	}
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return m, fmt.Errorf("%w: value %q", ErrInvalidLine, fields[1])
+	}
+	m.Value = v
+	if len(fields) == 3 {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return m, fmt.Errorf("%w: timestamp %q", ErrInvalidLine, fields[2])
+		}
+		m.Timestamp = int64(ts)
+	}
+	return m, nil
+}
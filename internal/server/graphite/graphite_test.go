@@ -0,0 +1,72 @@
+package graphite
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Metric
+		wantErr bool
+	}{
+		{name: "full line", line: "servers.web1.load 0.75 1700000000", want: Metric{Path: "servers.web1.load", Value: 0.75, Timestamp: 1700000000}},
+		{name: "without timestamp", line: "load 2", want: Metric{Path: "load", Value: 2}},
+		{
+			name: "tags",
+			line: "load;host=web1;dc=eu 1.5 1700000000",
+			want: Metric{Path: "load", Value: 1.5, Timestamp: 1700000000, Labels: map[string]string{"host": "web1", "dc": "eu"}},
+		},
+		{name: "without value", line: "load", wantErr: true},
+		{name: "bad value", line: "load high 1700000000", wantErr: true},
+		{name: "bad timestamp", line: "load 1 now", wantErr: true},
+		{name: "bad tag", line: "load;host 1", wantErr: true},
+		{name: "too many fields", line: "load 1 2 3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseLine(tt.line)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, m)
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	s := storage.NewMetricsStore()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ctx, l, s, zap.NewNop())
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("load;host=web1 0.5 1700000000\nbroken\nAlloc 7 1700000000\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		load, ok := s.GetGauge(storage.MetricKey("load", map[string]string{"host": "web1"}))
+		alloc, _ := s.GetGauge("Alloc")
+		return ok && load == 0.5 && alloc == 7
+	}, time.Second, time.Millisecond*10)
+
+	cancel()
+	require.NoError(t, <-done)
+}
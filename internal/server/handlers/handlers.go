@@ -3,17 +3,19 @@ package handlers
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/pprof"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -21,13 +23,12 @@ import (
 
 	"github.com/AlekseyKas/metrics/internal/config"
 	"github.com/AlekseyKas/metrics/internal/crypto"
+	"github.com/AlekseyKas/metrics/internal/replay"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
+	"github.com/AlekseyKas/metrics/internal/server/influx"
 	"github.com/AlekseyKas/metrics/internal/storage"
 )
 
-// Init type metrics gauge and counter
-type gauge float64
-type counter int64
-
 // Init server storage
 var StorageM storage.Storage
 
@@ -52,6 +53,25 @@ func InitConfig(args config.Args) {
 	Args = args
 }
 
+// Private keys of server, requests are not decrypted if nil
+var Decrypter *crypto.Decrypter
+
+// Set private keys loaded at startup
+func SetDecrypter(d *crypto.Decrypter) {
+	Decrypter = d
+}
+
+// Registry of agent keys, shared key is used if nil
+var Agents agentkeys.Registry
+
+// Set registry of agent keys
+func SetAgents(r agentkeys.Registry) {
+	Agents = r
+}
+
+// Key of agent in context of request
+type agentKeyCtx struct{}
+
 // Handlers server
 func Router(r chi.Router) {
 	r.Use(middleware.RequestID)
@@ -63,12 +83,26 @@ func Router(r chi.Router) {
 	r.Use(DecompressGzip)
 	// r.Use(Encrypt)
 	r.Get("/", getMetrics())
+	r.Get("/metrics", getMetricsPrometheus())
 	r.Get("/value/{typeMet}/{nameMet}", getMetric())
 	r.Get("/ping", checkConnection())
-	r.Post("/update/{typeMet}/{nameMet}/{value}", saveMetrics())
-	r.Post("/update/", saveMetricsJSON())
-	r.Post("/updates/", saveMetricsSlice())
 	r.Post("/value/", getMetricsJSON())
+	r.Get("/api/v1/series/{typeMet}/{nameMet}", getSeries())
+	r.Group(func(r chi.Router) {
+		r.Use(TrustedSubnet(Args.TrustedSubnet))
+		// value in URL is not signed, so key of agent can not be checked for it
+		r.Post("/update/{typeMet}/{nameMet}/{value}", saveMetrics())
+	})
+	// key of agent checks signatures of metrics and batches, routes without signature are not here
+	// nonces are shared by signed updates, so request can not be replayed on other route
+	replayGuard := Replay(Args.ReplayWindow, Args.NonceCacheSize)
+	r.Group(func(r chi.Router) {
+		r.Use(TrustedSubnet(Args.TrustedSubnet))
+		r.Use(AgentKey)
+		r.With(replayGuard).Post("/update/", saveMetricsJSON())
+		r.With(replayGuard).Post("/updates/", saveMetricsSlice())
+		r.Post("/api/v2/write", writeInflux())
+	})
 
 	r.Get("/debug/pprof/", pprof.Index)
 	r.Get("/debug/pprof/cmdline", pprof.Cmdline)
@@ -79,15 +113,17 @@ func Router(r chi.Router) {
 
 func Dencrypt(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if Args.PrivateKey != "" {
+		if Decrypter != nil {
 
 			out, err := io.ReadAll(r.Body)
 			if err != nil {
 				Logger.Error("Error read body: ", zap.Error(err))
 			}
-			data, err := crypto.DecryptData(out, Args.PrivateKey)
+			data, err := Decrypter.Decrypt(out)
 			if err != nil {
 				Logger.Error("Error decrypt data: ", zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+				return
 			}
 			r.ContentLength = int64(len(data))
 			r.Body = io.NopCloser(bytes.NewBuffer(data))
@@ -99,6 +135,130 @@ func Dencrypt(next http.Handler) http.Handler {
 	})
 }
 
+// Reject requests from addresses outside of subnet, every address is trusted if subnet is empty
+func TrustedSubnet(subnet string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if subnet == "" {
+			return next
+		}
+		_, trusted, err := net.ParseCIDR(subnet)
+		if err != nil {
+			Logger.Error("Error parsing trusted subnet, all updates are rejected: ", zap.Error(err))
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(clientIP(r))
+			if trusted == nil || ip == nil || !trusted.Contains(ip) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Reject requests with invalid signature of timestamp and nonce, stale timestamp or used nonce,
+// routes of middleware share nonces. Requests are not checked if window or key of request is empty
+func Replay(window time.Duration, size int) func(http.Handler) http.Handler {
+	var guard *replay.Guard
+	if window > 0 {
+		var err error
+		guard, err = replay.NewGuard(window, size)
+		if err != nil {
+			Logger.Error("Error init replay guard, all batches are rejected: ", zap.Error(err))
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		if window <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if guard == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			key := requestKey(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			out, err := io.ReadAll(r.Body)
+			if err != nil {
+				Logger.Error("Error read body: ", zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ts, err := replay.Verify([]byte(key), r.Header.Get(replay.HeaderTimestamp), r.Header.Get(replay.HeaderNonce), r.Header.Get(replay.HeaderSignature), out)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			err = guard.Check(ts, r.Header.Get(replay.HeaderNonce), time.Now())
+			if err != nil {
+				Logger.Info("Batch is rejected: ", zap.Error(err))
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(out))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Resolve key of agent from X-Agent-ID by registry, requests without ID are rejected
+// unless shared key is set and allowed for them. Key only checks signatures of handlers,
+// so it is not authentication of routes without signature
+func AgentKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Agents == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get(agentkeys.HeaderAgentID)
+		if id == "" {
+			if config.ArgsM.Key == "" || !config.ArgsM.AllowSharedKey {
+				http.Error(w, "agent ID is missing", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := Agents.Key(r.Context(), id)
+		switch {
+		case errors.Is(err, agentkeys.ErrRevoked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, agentkeys.ErrUnknownAgent):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			Logger.Error("Error getting key of agent: ", zap.String("agent", id), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), agentKeyCtx{}, key)))
+	})
+}
+
+// Key of agent resolved by registry or shared key
+func requestKey(r *http.Request) string {
+	if key, ok := r.Context().Value(agentKeyCtx{}).(string); ok {
+		return key
+	}
+	return config.ArgsM.Key
+}
+
+// Address of client from X-Real-IP, remote address is used if header is missing
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // Init type for zipping
 type gzipBodyWriter struct {
 	http.ResponseWriter
@@ -165,136 +325,47 @@ func saveMetricsSlice() http.HandlerFunc {
 		if err != nil {
 			Logger.Error("Error read body: ", zap.Error(err))
 		}
+		key := requestKey(r)
+		// batch is signed as a whole, unsigned batch is rejected when key is set
+		if key != "" && !storage.CheckBatch(out, []byte(key), r.Header.Get(storage.HeaderHash)) {
+			Logger.Error("Error compare hash of batch")
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		err = json.Unmarshal(out, &s)
 		if err != nil {
 			Logger.Error("Error unmarshaling request: ", zap.Error(err))
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		var typeMet string
-		var nameMet string
-		for i := 0; i < len(s); i++ {
-			typeMet = s[i].MType
-			nameMet = s[i].ID
-			metrics := StorageM.GetMetrics()
-
-			if config.ArgsM.Key != "" {
-				var b bool
-				b, err = compareHash(&s[i], []byte(config.ArgsM.Key))
-				if err != nil {
-					Logger.Error("Error compare hash of metrics: ", zap.Error(err))
-				}
-				if b {
-
-					//update gauge
-					if typeMet == "gauge" {
-						if s[i].Value != nil {
-							if metrics[nameMet] != gauge(*s[i].Value) {
-								err = StorageM.ChangeMetric(nameMet, gauge(*s[i].Value), config.ArgsM)
-								if err != nil {
-									Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-								}
-								err = StorageM.ChangeMetricDB(nameMet, *s[i].Value, typeMet, config.ArgsM)
-								if err != nil {
-									Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-								}
-								rw.WriteHeader(http.StatusOK)
-							}
-						}
-					}
-					//update counter
-					if typeMet == "counter" {
-						var valueMetInt int
-						if s[i].Delta != nil {
-							if _, ok := metrics[nameMet]; ok {
-								var ii int
-								ii, err = strconv.Atoi(fmt.Sprintf("%v", metrics[nameMet]))
-								if err != nil {
-									rw.WriteHeader(http.StatusBadRequest)
-									return
-								}
-								valueMetInt = int(*s[i].Delta) + ii
-								err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-								if err != nil {
-									Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-								}
-								err = StorageM.ChangeMetricDB(nameMet, valueMetInt, typeMet, config.ArgsM)
-								if err != nil {
-									Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-								}
-								rw.WriteHeader(http.StatusOK)
-							} else {
-								valueMetInt = int(*s[i].Delta)
-								err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-								if err != nil {
-									Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-								}
-								err = StorageM.ChangeMetricDB(nameMet, valueMetInt, typeMet, config.ArgsM)
-								if err != nil {
-									Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-								}
-								rw.WriteHeader(http.StatusOK)
-							}
-						}
-					}
-				}
-
-			} else {
-				if typeMet == "gauge" {
-					if s[i].Value != nil {
-						if metrics[nameMet] != gauge(*s[i].Value) {
-							err = StorageM.ChangeMetric(nameMet, gauge(*s[i].Value), config.ArgsM)
-							if err != nil {
-								Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-							}
-							err = StorageM.ChangeMetricDB(nameMet, *s[i].Value, typeMet, config.ArgsM)
-							if err != nil {
-								Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-							}
-							rw.WriteHeader(http.StatusOK)
-						}
-					}
-				}
-				//update counter
-				if typeMet == "counter" {
-					var valueMetInt int
-					if s[i].Delta != nil {
-						if _, ok := metrics[nameMet]; ok {
-							var ii int
-							ii, err = strconv.Atoi(fmt.Sprintf("%v", metrics[nameMet]))
-							if err != nil {
-								rw.WriteHeader(http.StatusBadRequest)
-								return
-							}
-							valueMetInt = int(*s[i].Delta) + ii
-							err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-							if err != nil {
-								Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-							}
-							err = StorageM.ChangeMetricDB(nameMet, valueMetInt, typeMet, config.ArgsM)
-							if err != nil {
-								Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-							}
-							rw.WriteHeader(http.StatusOK)
-						} else {
-							valueMetInt = int(*s[i].Delta)
-							err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-							if err != nil {
-								Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-							}
-							err = StorageM.ChangeMetricDB(nameMet, valueMetInt, typeMet, config.ArgsM)
-							if err != nil {
-								Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-							}
-							rw.WriteHeader(http.StatusOK)
-						}
-					}
-				}
-			}
+		// batch is saved entirely or not at all
+		err = StorageM.UpdateBatch(s)
+		switch {
+		case err == nil:
+			rw.WriteHeader(http.StatusOK)
+		case errors.Is(err, storage.ErrMissingValue), errors.Is(err, storage.ErrUnknownType), storage.IsInvalidMetric(err):
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		default:
+			Logger.Error("Error saving batch of metrics: ", zap.Error(err))
+			rw.WriteHeader(http.StatusInternalServerError)
 		}
 	})
 }
 
+// Save metric in storage and database
+func saveMetric(s *storage.JSONMetrics) error {
+	return storage.SaveMetric(StorageM, s)
+}
+
+// Type of metric supported by storage
+func knownType(typeMet string) bool {
+	switch typeMet {
+	case "gauge", "counter", "histogram", "summary":
+		return true
+	}
+	return false
+}
+
 // Handler for getting metrics format JSON
 func getMetricsJSON() http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -311,112 +382,78 @@ func getMetricsJSON() http.HandlerFunc {
 		if err != nil {
 			Logger.Error("Error unmarshaling request: ", zap.Error(err))
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
-
+			return
 		}
 
-		metrics := StorageM.GetMetrics()
 		typeMet := s.MType
-		nameMet := s.ID
+		nameMet := storage.MetricKey(s.ID, s.Labels)
 
-		if typeMet != "gauge" && typeMet != "counter" {
+		if !knownType(typeMet) {
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if typeMet == "gauge" && nameMet == "PollCount" {
+		if typeMet == "gauge" && s.ID == "PollCount" {
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
-		if typeMet == "counter" {
-
-			if _, ok := metrics[nameMet]; ok {
-
-				if typeMet == "counter" && strings.Split(reflect.ValueOf(metrics[nameMet]).Type().String(), ".")[1] == "counter" {
-					i, err := strconv.Atoi(fmt.Sprintf("%v", metrics[nameMet]))
-					if err != nil {
-						rw.WriteHeader(http.StatusBadRequest)
-					}
-					a := int64(i)
-					s.Delta = &a
-					var buf bytes.Buffer
-					if config.ArgsM.Key != "" {
-						calculateHash(&s, []byte(config.ArgsM.Key))
-						if err != nil {
-							Logger.Error("Error calculate hash: ", zap.Error(err))
-						}
-					}
-					encoder := json.NewEncoder(&buf)
-					err = encoder.Encode(s)
-					if err != nil {
-						Logger.Error("Error encode metrics", zap.Error(err))
-						http.Error(rw, err.Error(), http.StatusBadRequest)
-					}
-					_, err = rw.Write(buf.Bytes())
-					if err != nil {
-						Logger.Error("Error write data in buff: ", zap.Error(err))
-					}
-					rw.WriteHeader(http.StatusOK)
-					return
-				} else {
-					rw.WriteHeader(http.StatusNotFound)
-				}
-			} else {
+		switch typeMet {
+		case "counter":
+			delta, ok := StorageM.GetCounter(nameMet)
+			if !ok {
 				rw.WriteHeader(http.StatusNotFound)
+				return
 			}
-		}
-		if typeMet == "gauge" {
-			if _, ok := metrics[nameMet]; ok {
-				if strings.Split(reflect.ValueOf(metrics[nameMet]).Type().String(), ".")[1] == "gauge" {
-					float, err := strconv.ParseFloat(fmt.Sprintf("%v", metrics[nameMet]), 64)
-					if err != nil {
-						rw.WriteHeader(http.StatusBadRequest)
-					}
-					s.Value = &float
-					var buf bytes.Buffer
-					if config.ArgsM.Key != "" {
-						calculateHash(&s, []byte(config.ArgsM.Key))
-						if err != nil {
-							Logger.Error("Error calculate hash: ", zap.Error(err))
-						}
-					}
-					encoder := json.NewEncoder(&buf)
-					err = encoder.Encode(s)
-					if err != nil {
-						http.Error(rw, err.Error(), http.StatusBadRequest)
-					}
-					_, err = rw.Write(buf.Bytes())
-					if err != nil {
-						Logger.Error("Error write bytes to req: ", zap.Error(err))
-					}
-					rw.WriteHeader(http.StatusOK)
-					return
-				} else {
-					rw.WriteHeader(http.StatusNotFound)
-				}
-			} else {
+			s.Delta = &delta
+		case "gauge":
+			value, ok := StorageM.GetGauge(nameMet)
+			if !ok {
 				rw.WriteHeader(http.StatusNotFound)
+				return
 			}
-
+			s.Value = &value
+		case "histogram":
+			h, ok := StorageM.GetHistogram(nameMet)
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.SetHistogram(h)
+		case "summary":
+			sum, ok := StorageM.GetSummary(nameMet)
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.Observations = nil
+			s.SetSummary(sum)
+		}
+		if config.ArgsM.Key != "" {
+			calculateHash(&s, []byte(config.ArgsM.Key))
+		}
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		err = encoder.Encode(s)
+		if err != nil {
+			Logger.Error("Error encode metrics", zap.Error(err))
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		_, err = rw.Write(buf.Bytes())
+		if err != nil {
+			Logger.Error("Error write data in buff: ", zap.Error(err))
 		}
 	}
 }
 
 // Calculate sha256
 func calculateHash(s *storage.JSONMetrics, key []byte) {
-	// Init hash
-	var h hash.Hash
-	switch s.MType {
-	case "counter":
-		data := (fmt.Sprintf("%s:counter:%d", s.ID, *s.Delta))
-		h = hmac.New(sha256.New, key)
-		h.Write([]byte(data))
-		s.Hash = fmt.Sprintf("%x", h.Sum(nil))
-	case "gauge":
-		data := (fmt.Sprintf("%s:gauge:%f", s.ID, *s.Value))
-		h = hmac.New(sha256.New, key)
-		h.Write([]byte(data))
-		s.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	hash, err := storage.Hash(s, key)
+	if err != nil {
+		return
 	}
+	s.Hash = hash
 }
 
 // Save metrics from format JSON
@@ -436,112 +473,44 @@ func saveMetricsJSON() http.HandlerFunc {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		metrics := StorageM.GetMetrics()
-		typeMet := s.MType
-		nameMet := s.ID
-		if config.ArgsM.Key != "" {
+		if key := requestKey(req); key != "" {
 			var b bool
-			b, err = compareHash(&s, []byte(config.ArgsM.Key))
+			b, err = compareHash(&s, []byte(key))
 			if err != nil {
 				Logger.Error("Error compare hash of metrics: ", zap.Error(err))
 			}
 			if !b {
 				rw.WriteHeader(http.StatusBadRequest)
+				return
 			}
 		}
 
-		if typeMet != "gauge" && typeMet != "counter" {
+		if !knownType(s.MType) {
 			rw.WriteHeader(http.StatusNotImplemented)
 			return
 		}
-		// Update gauge
-		if typeMet == "gauge" {
-			if s.Value == nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			} else {
-				if metrics[nameMet] != gauge(*s.Value) {
-					err = StorageM.ChangeMetric(nameMet, gauge(*s.Value), config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-					}
-					err = StorageM.ChangeMetricDB(nameMet, *s.Value, typeMet, config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-					}
-					rw.WriteHeader(http.StatusOK)
-					return
-				}
-			}
-		}
-		// Update counter
-		if typeMet == "counter" {
-			if err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			var valueMetInt int
-			if s.Delta != nil {
-				if _, ok := metrics[nameMet]; ok {
-					var i int
-					i, err = strconv.Atoi(fmt.Sprintf("%v", metrics[nameMet]))
-					if err != nil {
-						rw.WriteHeader(http.StatusBadRequest)
-						return
-					}
-					valueMetInt = int(*s.Delta) + i
-					err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-					}
-					err = StorageM.ChangeMetricDB(nameMet, valueMetInt, typeMet, config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-					}
-					rw.WriteHeader(http.StatusOK)
-					return
-				} else {
-					valueMetInt = int(*s.Delta)
-					err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-					}
-					err = StorageM.ChangeMetricDB(nameMet, valueMetInt, typeMet, config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetricDB: ", zap.Error(err))
-					}
-					rw.WriteHeader(http.StatusOK)
-					return
-				}
-			} else {
-				rw.WriteHeader(http.StatusBadRequest)
-			}
+		err = saveMetric(&s)
+		switch {
+		case err == nil:
+			rw.WriteHeader(http.StatusOK)
+		case errors.Is(err, storage.ErrMissingValue) && s.MType == "gauge":
+			rw.WriteHeader(http.StatusInternalServerError)
+		case errors.Is(err, storage.ErrMissingValue), storage.IsInvalidMetric(err):
+			rw.WriteHeader(http.StatusBadRequest)
+		default:
+			Logger.Error("Error saving metric: ", zap.Error(err))
+			rw.WriteHeader(http.StatusInternalServerError)
 		}
 	}
 }
 
 // Compare hashe metrics
 func compareHash(s *storage.JSONMetrics, key []byte) (b bool, err error) {
-	var h hash.Hash
-	switch s.MType {
-	case "counter":
-		data := (fmt.Sprintf("%s:counter:%d", s.ID, *s.Delta))
-		h = hmac.New(sha256.New, key)
-		h.Write([]byte(data))
-	case "gauge":
-		data := (fmt.Sprintf("%s:gauge:%f", s.ID, *s.Value))
-		h = hmac.New(sha256.New, key)
-		_, err = h.Write([]byte(data))
-		if err != nil {
-			Logger.Error("Error write data hash: ", zap.Error(err))
-		}
+	hash, err := storage.Hash(s, key)
+	if err != nil {
+		return false, err
 	}
-	h.Sum(nil)
-	if fmt.Sprintf("%x", h.Sum(nil)) == s.Hash {
-		b = true
-	}
-	return b, nil
+	return hash == s.Hash, nil
 }
 
 // Getting all metrics
@@ -565,54 +534,342 @@ func getMetrics() http.HandlerFunc {
 	}
 }
 
-// Get value metric
-func getMetric() http.HandlerFunc {
+// Getting all metrics in Prometheus text exposition format
+func getMetricsPrometheus() http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
+		metrics, err := StorageM.GetMetricsJSON()
+		if err != nil {
+			Logger.Error("Error getting metrics format JSON GetMetricsJSON: ", zap.Error(err))
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// series are grouped by sanitized name, so every name has one TYPE line
+		sort.Slice(metrics, func(i, j int) bool {
+			ni, nj := prometheusName(metrics[i].ID), prometheusName(metrics[j].ID)
+			if ni != nj {
+				return ni < nj
+			}
+			if metrics[i].MType != metrics[j].MType {
+				return metrics[i].MType < metrics[j].MType
+			}
+			return prometheusLabels(metrics[i].Labels) < prometheusLabels(metrics[j].Labels)
+		})
+		var buf bytes.Buffer
+		var last, lastType string
+		seen := make(map[string]bool)
+		for _, m := range metrics {
+			name := prometheusName(m.ID)
+			if name != last {
+				fmt.Fprintf(&buf, "# TYPE %s %s\n", name, m.MType)
+				last, lastType = name, m.MType
+			}
+			series := name + prometheusLabels(m.Labels)
+			// IDs sanitized to the same name can not have other type or the same labels
+			if m.MType != lastType || seen[series] {
+				Logger.Warn("Metric is skipped, its name clashes with other metric", zap.String("id", m.ID), zap.String("series", series))
+				continue
+			}
+			seen[series] = true
+			switch m.MType {
+			case "gauge":
+				fmt.Fprintf(&buf, "%s %s\n", series, strconv.FormatFloat(*m.Value, 'g', -1, 64))
+			case "counter":
+				fmt.Fprintf(&buf, "%s %d\n", series, *m.Delta)
+			case "histogram":
+				writePrometheusHistogram(&buf, name, m)
+			case "summary":
+				writePrometheusSummary(&buf, name, m)
+			}
+		}
+		rw.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		_, err = rw.Write(buf.Bytes())
+		if err != nil {
+			Logger.Error("Error write bytes to req: ", zap.Error(err))
+		}
+	}
+}
 
-		metrics := StorageM.GetMetrics()
+// Save metrics of InfluxDB line protocol, integer fields are counters and float fields are gauges.
+// Body is signed as a whole like batch of /updates/ when key is set, timestamps of lines are ignored
+func writeInflux() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		out, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := requestKey(req)
+		if key != "" && !storage.CheckBatch(out, []byte(key), req.Header.Get(storage.HeaderHash)) {
+			Logger.Error("Error compare hash of line protocol body")
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		points, err := influx.Parse(out)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// all points are saved in one batch, so invalid point rejects whole request
+		var batch []storage.JSONMetrics
+		for _, p := range points {
+			for field, v := range p.Fields {
+				m := storage.JSONMetrics{ID: p.Measurement + "_" + field, Labels: p.Tags}
+				switch v := v.(type) {
+				case int64:
+					m.MType, m.Delta = "counter", &v
+				case uint64:
+					if v > math.MaxInt64 {
+						http.Error(rw, fmt.Sprintf("field %s overflows counter", field), http.StatusBadRequest)
+						return
+					}
+					delta := int64(v)
+					m.MType, m.Delta = "counter", &delta
+				case float64:
+					m.MType, m.Value = "gauge", &v
+				default:
+					// strings and booleans have no metric type
+					continue
+				}
+				batch = append(batch, m)
+			}
+		}
+		err = StorageM.UpdateBatch(batch)
+		if storage.IsInvalidMetric(err) {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			Logger.Error("Error saving batch of metrics: ", zap.Error(err))
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
 
+// Getting history of metric in range from, to, other query parameters are labels of metric
+func getSeries() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
 		typeMet := chi.URLParam(req, "typeMet")
-		nameMet := chi.URLParam(req, "nameMet")
+		nameMet := queryMetricKey(req, chi.URLParam(req, "nameMet"), "from", "to")
+		rw.Header().Add("Content-Type", "application/json")
 
+		if typeMet != "gauge" && typeMet != "counter" {
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		from, err := parseTime(req.URL.Query().Get("from"), time.Time{})
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTime(req.URL.Query().Get("to"), time.Now())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ok bool
 		switch typeMet {
 		case "gauge":
-			typeMet = "gauge"
+			_, ok = StorageM.GetGauge(nameMet)
 		case "counter":
-			typeMet = "counter"
+			_, ok = StorageM.GetCounter(nameMet)
 		}
-		if typeMet != "gauge" && typeMet != "counter" {
-			rw.Header().Add("Content-Type", "text/plain")
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		samples, err := StorageM.GetSeries(nameMet, typeMet, from, to)
+		if err != nil {
+			Logger.Error("Error getting series of metric: ", zap.Error(err))
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		err = json.NewEncoder(&buf).Encode(samples)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		_, err = rw.Write(buf.Bytes())
+		if err != nil {
+			Logger.Error("Error write bytes to req: ", zap.Error(err))
+		}
+	}
+}
+
+// Key of metric from name in URL and labels from query, e.g. /value/gauge/Alloc?host=a,
+// parameters in skip are not labels
+func queryMetricKey(req *http.Request, nameMet string, skip ...string) string {
+	labels := make(map[string]string)
+	for name, values := range req.URL.Query() {
+		if len(values) == 0 || contains(skip, name) {
+			continue
+		}
+		labels[name] = values[0]
+	}
+	return storage.MetricKey(nameMet, labels)
+}
+
+// Slice contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse time in RFC3339 or unix seconds, empty value gives def
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Write buckets, sum and count of histogram in Prometheus format
+func writePrometheusHistogram(buf *bytes.Buffer, name string, m storage.JSONMetrics) {
+	labels := make(map[string]string, len(m.Labels)+1)
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	for _, b := range m.Buckets {
+		labels["le"] = strconv.FormatFloat(b.UpperBound, 'g', -1, 64)
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, prometheusLabels(labels), b.Count)
+	}
+	labels["le"] = "+Inf"
+	fmt.Fprintf(buf, "%s_bucket%s %d\n", name, prometheusLabels(labels), *m.Count)
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, prometheusLabels(m.Labels), strconv.FormatFloat(*m.Sum, 'g', -1, 64))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, prometheusLabels(m.Labels), *m.Count)
+}
+
+// Write quantiles, sum and count of summary in Prometheus format
+func writePrometheusSummary(buf *bytes.Buffer, name string, m storage.JSONMetrics) {
+	labels := make(map[string]string, len(m.Labels)+1)
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	for _, q := range m.Quantiles {
+		labels["quantile"] = strconv.FormatFloat(q.Quantile, 'g', -1, 64)
+		fmt.Fprintf(buf, "%s%s %s\n", name, prometheusLabels(labels), strconv.FormatFloat(q.Value, 'g', -1, 64))
+	}
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, prometheusLabels(m.Labels), strconv.FormatFloat(*m.Sum, 'g', -1, 64))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, prometheusLabels(m.Labels), *m.Count)
+}
+
+// Labels of metric in Prometheus format
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	sanitized := make(map[string]string, len(labels))
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		name = strings.ReplaceAll(prometheusName(name), ":", "_")
+		if _, ok := sanitized[name]; !ok {
+			names = append(names, name)
+		}
+		sanitized[name] = value
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, prometheusEscaper.Replace(sanitized[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Escaping of label values in Prometheus text format, other characters are written as is
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Replace characters not allowed in Prometheus metric names
+func prometheusName(id string) string {
+	b := []byte(id)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Get value metric, query parameters are labels of metric
+func getMetric() http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		typeMet := chi.URLParam(req, "typeMet")
+		nameMet := queryMetricKey(req, chi.URLParam(req, "nameMet"))
+
+		rw.Header().Add("Content-Type", "text/plain")
+		if !knownType(typeMet) {
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
 		if typeMet == "gauge" && nameMet == "PollCount" {
-			rw.Header().Add("Content-Type", "text/plain")
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
-		if _, ok := metrics[nameMet]; ok {
-			if typeMet == "counter" {
-				rw.Header().Add("Content-Type", "text/plain")
-				rw.WriteHeader(http.StatusOK)
-				_, err := rw.Write([]byte(fmt.Sprintf("%v", metrics[nameMet])))
-				if err != nil {
-					Logger.Error("Error write bytes to req: ", zap.Error(err))
-				}
+		var value string
+		switch typeMet {
+		case "counter":
+			delta, ok := StorageM.GetCounter(nameMet)
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
 				return
 			}
-		} else {
-			rw.Header().Add("Content-Type", "text/plain")
-			rw.WriteHeader(http.StatusNotFound)
-		}
-		if typeMet == "gauge" && nameMet != "PollCount" {
-			rw.Header().Add("Content-Type", "text/plain")
-			rw.WriteHeader(http.StatusOK)
-			_, err := rw.Write([]byte(fmt.Sprintf("%v", metrics[nameMet])))
-			if err != nil {
-				Logger.Error("Error write bytes to req: ", zap.Error(err))
+			value = strconv.FormatInt(delta, 10)
+		case "gauge":
+			v, ok := StorageM.GetGauge(nameMet)
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
 			}
-			return
+			value = fmt.Sprintf("%v", v)
+		case "histogram":
+			h, ok := StorageM.GetHistogram(nameMet)
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var b strings.Builder
+			for _, bucket := range h.Buckets {
+				fmt.Fprintf(&b, "le=\"%v\" %d\n", bucket.UpperBound, bucket.Count)
+			}
+			fmt.Fprintf(&b, "sum %v\ncount %d", h.Sum, h.Count)
+			value = b.String()
+		case "summary":
+			sum, ok := StorageM.GetSummary(nameMet)
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var b strings.Builder
+			for _, q := range sum.Quantiles {
+				fmt.Fprintf(&b, "quantile=\"%v\" %v\n", q.Quantile, q.Value)
+			}
+			fmt.Fprintf(&b, "sum %v\ncount %d", sum.Sum, sum.Count)
+			value = b.String()
+		}
+		rw.WriteHeader(http.StatusOK)
+		_, err := rw.Write([]byte(value))
+		if err != nil {
+			Logger.Error("Error write bytes to req: ", zap.Error(err))
 		}
 	}
 }
@@ -623,83 +880,59 @@ func saveMetrics() http.HandlerFunc {
 		nameMet := chi.URLParam(req, "nameMet")
 		value := chi.URLParam(req, "value")
 
-		// Get metrics from memory
-		metrics := StorageM.GetMetrics()
-
+		rw.Header().Add("Content-Type", "text/plain")
+		s := storage.JSONMetrics{
+			ID:    nameMet,
+			MType: typeMet,
+		}
 		switch typeMet {
 		case "gauge":
-			typeMet = "gauge"
-		case "counter":
-			typeMet = "counter"
-		}
-		if typeMet != "gauge" && typeMet != "counter" {
-			rw.Header().Add("Content-Type", "text/plain")
-			rw.WriteHeader(http.StatusNotImplemented)
-		}
-		// Update gauge
-		if typeMet == "gauge" && nameMet != "PollCount" {
 			valueMetFloat, err := strconv.ParseFloat(value, 64)
 			if err != nil {
-				rw.Header().Add("Content-Type", "text/plain")
 				rw.WriteHeader(http.StatusBadRequest)
 				return
-			} else {
-				if metrics[nameMet] != gauge(valueMetFloat) {
-					err = StorageM.ChangeMetric(nameMet, gauge(valueMetFloat), config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-					}
-					rw.Header().Add("Content-Type", "text/plain")
-					rw.WriteHeader(http.StatusOK)
-				}
 			}
-		}
-		// Update counter
-		if typeMet == "counter" {
-			valueMetInt, err := strconv.Atoi(value)
+			s.Value = &valueMetFloat
+		case "counter":
+			valueMetInt, err := strconv.ParseInt(value, 10, 64)
 			if err != nil {
-				rw.Header().Add("Content-Type", "text/plain")
 				rw.WriteHeader(http.StatusBadRequest)
+				return
 			}
-			if err == nil {
-				if _, ok := metrics[nameMet]; ok {
-					var i int
-					i, err = strconv.Atoi(fmt.Sprintf("%v", metrics[nameMet]))
-					if err != nil {
-						rw.Header().Add("Content-Type", "text/plain")
-						rw.WriteHeader(http.StatusBadRequest)
-					}
-					valueMetInt = valueMetInt + i
-					err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-					}
-					rw.Header().Add("Content-Type", "text/plain")
-					rw.WriteHeader(http.StatusOK)
-				} else {
-					err = StorageM.ChangeMetric(nameMet, counter(valueMetInt), config.ArgsM)
-					if err != nil {
-						Logger.Error("Error changing metric ChangeMetric: ", zap.Error(err))
-					}
-				}
+			s.Delta = &valueMetInt
+		case "summary":
+			observation, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
 			}
+			s.Observations = []float64{observation}
+		default:
+			rw.WriteHeader(http.StatusNotImplemented)
+			return
 		}
+		err := saveMetric(&s)
+		if storage.IsInvalidMetric(err) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			Logger.Error("Error saving metric: ", zap.Error(err))
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
 	}
 }
 
 // Checking connection to database
 func checkConnection() http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
-		if config.ArgsM.DBURL != "" {
-
-			err := StorageM.CheckConnection()
-			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-			} else {
-				rw.WriteHeader(http.StatusOK)
-			}
-		} else {
+		err := StorageM.Ping()
+		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		rw.WriteHeader(http.StatusOK)
 	}
 }
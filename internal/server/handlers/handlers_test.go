@@ -3,13 +3,23 @@ package handlers
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AlekseyKas/metrics/internal/config"
+	"github.com/AlekseyKas/metrics/internal/crypto"
+	"github.com/AlekseyKas/metrics/internal/replay"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
 	"github.com/AlekseyKas/metrics/internal/storage"
-	"github.com/fatih/structs"
 	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -19,9 +29,7 @@ var body []byte
 
 func TestRouter(t *testing.T) {
 
-	s := &storage.MetricsStore{
-		MM: structs.Map(storage.Metrics{}),
-	}
+	s := storage.NewMetricsStore()
 	SetStorage(s)
 	type want struct {
 		contentType string
@@ -133,14 +141,14 @@ func TestRouter(t *testing.T) {
 		},
 
 		{
-			name:   "saveMetricsSlice success 1#",
+			name:   "saveMetricsSlice unsigned 1#",
 			url:    "/updates/",
 			method: "POST",
 			key:    "ssds",
 			body:   []byte(`[{"ID": "Alloc", "type": "gauge", "value": 3.1}]`),
 			want: want{
 				contentType: "application/json",
-				statusCode:  200,
+				statusCode:  400,
 			},
 		},
 
@@ -155,14 +163,14 @@ func TestRouter(t *testing.T) {
 			},
 		},
 		{
-			name:   "saveMetricsSlice success 3#",
+			name:   "saveMetricsSlice unsigned 3#",
 			url:    "/updates/",
 			method: "POST",
 			key:    "lll",
 			body:   []byte(`[{"ID": "PollCount", "type": "counter", "delta": 102}]`),
 			want: want{
 				contentType: "application/json",
-				statusCode:  200,
+				statusCode:  400,
 			},
 		},
 		{
@@ -282,6 +290,8 @@ func Test_compareHash(t *testing.T) {
 func Test_calculateHash(t *testing.T) {
 	f := float64(99.1)
 	c := int64(99)
+	sum := float64(1.7)
+	count := int64(4)
 
 	type args struct {
 		s   *storage.JSONMetrics
@@ -317,6 +327,45 @@ func Test_calculateHash(t *testing.T) {
 			},
 			wantHash: "10cf641702fb80988f18a68a913dd980d0b10a9e24332be9edd5f4da92b12a22",
 		},
+		{
+			name: "Success calculate with labels",
+			args: args{
+				s: &storage.JSONMetrics{
+					ID:     "Alloc",
+					MType:  "gauge",
+					Value:  &f,
+					Labels: map[string]string{"host": "agent-1"},
+				},
+				key: []byte("key"),
+			},
+			wantHash: "5e2b02fb30da836775d0487a1f02182cbef9c5371097405a4c02625deacf7fd7",
+		},
+		{
+			name: "Success calculate histogram",
+			args: args{
+				s: &storage.JSONMetrics{
+					ID:      "Latency",
+					MType:   "histogram",
+					Buckets: []storage.Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 3}},
+					Sum:     &sum,
+					Count:   &count,
+				},
+				key: []byte("key"),
+			},
+			wantHash: "445d34656ae08bd1ea4eee7e6a5bd94075e25cf8b657acefacb48be18a71819b",
+		},
+		{
+			name: "Success calculate summary",
+			args: args{
+				s: &storage.JSONMetrics{
+					ID:           "Duration",
+					MType:        "summary",
+					Observations: []float64{1, 2},
+				},
+				key: []byte("key"),
+			},
+			wantHash: "06ab950d3a3598517d7d8272820c4eee656155590f658780711ba62118076563",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -371,6 +420,552 @@ func Test_getMetrics(t *testing.T) {
 	}
 }
 
+func Test_getMetricsPrometheus(t *testing.T) {
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	type want struct {
+		contentType string
+		statusCode  int
+		lines       []string
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		method string
+		want   want
+	}{
+		{
+			name:   "fist sample#",
+			url:    "/metrics",
+			method: "GET",
+			want: want{
+				contentType: "text/plain; version=0.0.4; charset=utf-8",
+				statusCode:  200,
+				lines: []string{
+					"# TYPE Alloc gauge\nAlloc 0\n",
+					"# TYPE PollCount counter\nPollCount 0\n",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", Router)
+
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.url, nil)
+			require.NoError(t, err)
+
+			resp, errr := http.DefaultClient.Do(req)
+			require.NoError(t, errr)
+			defer resp.Body.Close()
+			require.Equal(t, tt.want.statusCode, resp.StatusCode)
+			require.Equal(t, tt.want.contentType, resp.Header.Get("Content-Type"))
+
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			for _, line := range tt.want.lines {
+				require.Contains(t, string(b), line)
+			}
+		})
+	}
+}
+
+func Test_getSeries(t *testing.T) {
+	s := storage.NewMetricsStore()
+	s.SetSeriesLimit(2)
+	SetStorage(s)
+	config.ArgsM.Key = ""
+	r := chi.NewRouter()
+	r.Route("/", Router)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, url := range []string{"/update/gauge/Alloc/1", "/update/gauge/Alloc/2", "/update/gauge/Alloc/3"} {
+		resp, err := http.Post(ts.URL+url, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	type want struct {
+		statusCode int
+		count      int
+	}
+	tests := []struct {
+		name string
+		url  string
+		want want
+	}{
+		{
+			name: "ring keeps last samples#",
+			url:  "/api/v1/series/gauge/Alloc",
+			want: want{statusCode: 200, count: 2},
+		},
+		{
+			name: "range in the past#",
+			url:  "/api/v1/series/gauge/Alloc?from=0&to=1",
+			want: want{statusCode: 200, count: 0},
+		},
+		{
+			name: "wrong type#",
+			url:  "/api/v1/series/counter/Alloc",
+			want: want{statusCode: 404},
+		},
+		{
+			name: "unknown metric#",
+			url:  "/api/v1/series/gauge/unknown",
+			want: want{statusCode: 404},
+		},
+		{
+			name: "bad time#",
+			url:  "/api/v1/series/gauge/Alloc?from=yesterday",
+			want: want{statusCode: 400},
+		},
+		{
+			name: "unknown type#",
+			url:  "/api/v1/series/test/Alloc",
+			want: want{statusCode: 501},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.url)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.want.statusCode, resp.StatusCode)
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var samples []storage.Sample
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&samples))
+			require.Len(t, samples, tt.want.count)
+			if tt.want.count == 2 {
+				require.Equal(t, float64(2), *samples[0].Value)
+				require.Equal(t, float64(3), *samples[1].Value)
+			}
+		})
+	}
+}
+
+func TestRouterLabels(t *testing.T) {
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	config.ArgsM.Key = ""
+	r := chi.NewRouter()
+	r.Route("/", Router)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/updates/", "application/json", bytes.NewBufferString(`[
+		{"id": "Alloc", "type": "gauge", "value": 1, "labels": {"host": "agent-1"}},
+		{"id": "Alloc", "type": "gauge", "value": 2, "labels": {"host": "agent-2"}}
+	]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	tests := []struct {
+		name string
+		body string
+		want float64
+	}{
+		{name: "agent-1#", body: `{"id": "Alloc", "type": "gauge", "labels": {"host": "agent-1"}}`, want: 1},
+		{name: "agent-2#", body: `{"id": "Alloc", "type": "gauge", "labels": {"host": "agent-2"}}`, want: 2},
+		{name: "without labels#", body: `{"id": "Alloc", "type": "gauge"}`, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/value/", "application/json", bytes.NewBufferString(tt.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var m storage.JSONMetrics
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+			require.Equal(t, tt.want, *m.Value)
+		})
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "# TYPE Alloc gauge\nAlloc 0\nAlloc{host=\"agent-1\"} 1\nAlloc{host=\"agent-2\"} 2\n")
+
+	// labels of value and series are taken from query
+	urls := []struct {
+		name       string
+		url        string
+		statusCode int
+		body       string
+		series     bool
+	}{
+		{name: "value agent-1#", url: "/value/gauge/Alloc?host=agent-1", statusCode: http.StatusOK, body: "1"},
+		{name: "value agent-2#", url: "/value/gauge/Alloc?host=agent-2", statusCode: http.StatusOK, body: "2"},
+		{name: "value unknown host#", url: "/value/gauge/Alloc?host=agent-3", statusCode: http.StatusNotFound},
+		{name: "series agent-2#", url: "/api/v1/series/gauge/Alloc?host=agent-2&from=0", statusCode: http.StatusOK, series: true},
+		{name: "series unknown host#", url: "/api/v1/series/gauge/Alloc?host=agent-3", statusCode: http.StatusNotFound},
+	}
+	for _, tt := range urls {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + tt.url)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.statusCode, resp.StatusCode)
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			switch {
+			case tt.body != "":
+				require.Equal(t, tt.body, string(b))
+			case tt.series:
+				var samples []storage.Sample
+				require.NoError(t, json.Unmarshal(b, &samples))
+				require.Len(t, samples, 1)
+				require.Equal(t, float64(2), *samples[0].Value)
+			}
+		})
+	}
+}
+
+func TestRouterHistogram(t *testing.T) {
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	config.ArgsM.Key = ""
+	r := chi.NewRouter()
+	r.Route("/", Router)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		statusCode int
+	}{
+		{
+			name:       "update#",
+			url:        "/update/",
+			body:       `{"id": "Latency", "type": "histogram", "buckets": [{"le": 0.1, "count": 1}, {"le": 1, "count": 3}], "sum": 1.7, "count": 4}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "merge#",
+			url:        "/updates/",
+			body:       `[{"id": "Latency", "type": "histogram", "buckets": [{"le": 0.1, "count": 0}, {"le": 1, "count": 1}], "sum": 0.5, "count": 2}]`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "buckets mismatch#",
+			url:        "/update/",
+			body:       `{"id": "Latency", "type": "histogram", "buckets": [{"le": 5, "count": 1}], "sum": 1, "count": 1}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "decreasing counts#",
+			url:        "/updates/",
+			body:       `[{"id": "Other", "type": "histogram", "buckets": [{"le": 1, "count": 3}, {"le": 2, "count": 1}], "sum": 1, "count": 3}]`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "missing sum#",
+			url:        "/update/",
+			body:       `{"id": "Latency", "type": "histogram", "count": 1}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+tt.url, "application/json", bytes.NewBufferString(tt.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+
+	resp, err := http.Post(ts.URL+"/value/", "application/json", bytes.NewBufferString(`{"id": "Latency", "type": "histogram"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var m storage.JSONMetrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	require.Equal(t, []storage.Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 4}}, m.Buckets)
+	require.Equal(t, 2.2, *m.Sum)
+	require.Equal(t, int64(6), *m.Count)
+
+	resp, err = http.Get(ts.URL + "/value/histogram/Latency")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "le=\"0.1\" 1\nle=\"1\" 4\nsum 2.2\ncount 6", string(b))
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "# TYPE Latency histogram\n"+
+		"Latency_bucket{le=\"0.1\"} 1\n"+
+		"Latency_bucket{le=\"1\"} 4\n"+
+		"Latency_bucket{le=\"+Inf\"} 6\n"+
+		"Latency_sum 2.2\n"+
+		"Latency_count 6\n")
+}
+
+func TestRouterSummary(t *testing.T) {
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	config.ArgsM.Key = ""
+	r := chi.NewRouter()
+	r.Route("/", Router)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		statusCode int
+	}{
+		{
+			name:       "update#",
+			url:        "/update/",
+			body:       `{"id": "Duration", "type": "summary", "observations": [1, 2, 3]}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "updates#",
+			url:        "/updates/",
+			body:       `[{"id": "Duration", "type": "summary", "observations": [4]}]`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "url update#",
+			url:        "/update/summary/Duration/5",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "url update bad value#",
+			url:        "/update/summary/Duration/none",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "missing observations#",
+			url:        "/update/",
+			body:       `{"id": "Duration", "type": "summary"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "type mismatch#",
+			url:        "/update/",
+			body:       `{"id": "Alloc", "type": "summary", "observations": [1]}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+tt.url, "application/json", bytes.NewBufferString(tt.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+
+	resp, err := http.Post(ts.URL+"/value/", "application/json", bytes.NewBufferString(`{"id": "Duration", "type": "summary"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var m storage.JSONMetrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	require.Equal(t, []storage.Quantile{{Quantile: 0.5, Value: 3}, {Quantile: 0.9, Value: 5}, {Quantile: 0.99, Value: 5}}, m.Quantiles)
+	require.Equal(t, float64(15), *m.Sum)
+	require.Equal(t, int64(5), *m.Count)
+
+	resp, err = http.Get(ts.URL + "/value/summary/Duration")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "quantile=\"0.5\" 3\nquantile=\"0.9\" 5\nquantile=\"0.99\" 5\nsum 15\ncount 5", string(b))
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "# TYPE Duration summary\n"+
+		"Duration{quantile=\"0.5\"} 3\n"+
+		"Duration{quantile=\"0.9\"} 5\n"+
+		"Duration{quantile=\"0.99\"} 5\n"+
+		"Duration_sum 15\n"+
+		"Duration_count 5\n")
+}
+
+func TestRouterInflux(t *testing.T) {
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	r := chi.NewRouter()
+	r.Route("/", Router)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+	}{
+		{name: "write#", body: "cpu,host=web1 usage=0.5,procs=3i,state=\"ok\" 1700000000000000000\n", statusCode: http.StatusNoContent},
+		{name: "add to counter#", body: "cpu,host=web1 procs=2i\n", statusCode: http.StatusNoContent},
+		{name: "invalid line#", body: "cpu usage=\n", statusCode: http.StatusBadRequest},
+		{name: "type mismatch#", body: "cpu,host=web1 procs=1.5\n", statusCode: http.StatusBadRequest},
+		// valid points before invalid one are not saved
+		{name: "rejected entirely#", body: "cpu,host=web1 procs=10i\ncpu,host=web1 procs=1.5\n", statusCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/api/v2/write?org=o&bucket=b", "text/plain", bytes.NewBufferString(tt.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+
+	labels := map[string]string{"host": "web1"}
+	usage, ok := s.GetGauge(storage.MetricKey("cpu_usage", labels))
+	require.True(t, ok)
+	require.Equal(t, 0.5, usage)
+	procs, ok := s.GetCounter(storage.MetricKey("cpu_procs", labels))
+	require.True(t, ok)
+	require.Equal(t, int64(5), procs)
+	_, ok = s.GetGauge(storage.MetricKey("cpu_state", labels))
+	require.False(t, ok)
+}
+
+func TestRouterInfluxHash(t *testing.T) {
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	config.ArgsM.Key = "key"
+	defer func() { config.ArgsM.Key = "" }()
+	r := chi.NewRouter()
+	r.Route("/", Router)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	body := []byte("cpu usage=0.5\n")
+	tests := []struct {
+		name       string
+		hash       string
+		statusCode int
+	}{
+		{name: "signed#", hash: storage.HashBatch(body, []byte("key")), statusCode: http.StatusNoContent},
+		{name: "wrong key#", hash: storage.HashBatch(body, []byte("other")), statusCode: http.StatusBadRequest},
+		{name: "unsigned#", statusCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v2/write", bytes.NewReader(body))
+			require.NoError(t, err)
+			if tt.hash != "" {
+				req.Header.Set(storage.HeaderHash, tt.hash)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	SetStorage(storage.NewMetricsStore())
+	tests := []struct {
+		name       string
+		subnet     string
+		url        string
+		realIP     string
+		statusCode int
+	}{
+		{name: "without subnet#", url: "/update/gauge/Alloc/1", statusCode: http.StatusOK},
+		{name: "trusted#", subnet: "10.0.0.0/8", url: "/update/gauge/Alloc/1", realIP: "10.1.2.3", statusCode: http.StatusOK},
+		{name: "untrusted#", subnet: "10.0.0.0/8", url: "/update/gauge/Alloc/1", realIP: "192.168.0.1", statusCode: http.StatusForbidden},
+		{name: "untrusted batch#", subnet: "10.0.0.0/8", url: "/updates/", realIP: "192.168.0.1", statusCode: http.StatusForbidden},
+		{name: "remote address#", subnet: "10.0.0.0/8", url: "/update/", statusCode: http.StatusForbidden},
+		{name: "invalid subnet#", subnet: "10.0.0.0", url: "/update/gauge/Alloc/1", realIP: "10.1.2.3", statusCode: http.StatusForbidden},
+		{name: "value is not checked#", subnet: "10.0.0.0/8", url: "/value/", realIP: "192.168.0.1", statusCode: http.StatusOK},
+	}
+	defer InitConfig(config.Args{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitConfig(config.Args{TrustedSubnet: tt.subnet})
+			r := chi.NewRouter()
+			r.Route("/", Router)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL+tt.url, bytes.NewBufferString(`{"id": "Alloc", "type": "gauge"}`))
+			require.NoError(t, err)
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func Test_getMetricsPrometheusGroups(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	require.NoError(t, s.UpdateGauge(storage.MetricKey("http.requests", map[string]string{"path": "/a"}), 1))
+	require.NoError(t, s.UpdateGauge(storage.MetricKey("http_requests", map[string]string{"path": "/b"}), 2))
+	require.NoError(t, s.UpdateGauge(storage.MetricKey("http-requests", map[string]string{"path": "/a"}), 3))
+	require.NoError(t, s.UpdateGauge(storage.MetricKey("Quoted", map[string]string{"v": "a\tb\"c\\d\né"}), 4))
+	_, err := s.UpdateCounter("http.requests", 5)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	getMetricsPrometheus()(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	// one TYPE line for IDs with the same sanitized name, clashing series are skipped
+	require.Equal(t, 1, strings.Count(body, "# TYPE http_requests "))
+	require.Contains(t, body, "# TYPE http_requests counter\nhttp_requests 5\n")
+	require.NotContains(t, body, `path="/b"`)
+	// only backslash, quote and new line are escaped in label values
+	require.Contains(t, body, "Quoted{v=\"a\tb\\\"c\\\\d\\né\"} 4\n")
+}
+
+func Test_prometheusName(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{name: "valid", id: "HeapAlloc", want: "HeapAlloc"},
+		{name: "dots and dashes", id: "http.requests-total", want: "http_requests_total"},
+		{name: "leading digit", id: "1min", want: "_min"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, prometheusName(tt.id))
+		})
+	}
+}
+
 func Test_getMetric(t *testing.T) {
 
 	type want struct {
@@ -583,9 +1178,7 @@ func Test_checkConnection(t *testing.T) {
 
 func TestRouterCompressDecompress(t *testing.T) {
 
-	s := &storage.MetricsStore{
-		MM: structs.Map(storage.Metrics{}),
-	}
+	s := storage.NewMetricsStore()
 	SetStorage(s)
 	type want struct {
 		contentType string
@@ -734,3 +1327,393 @@ func TestRouterCompressDecompress(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkSaveMetricsSlice(b *testing.B) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	config.ArgsM.Key = ""
+	for _, size := range []int{1000, 5000} {
+		batch := make([]storage.JSONMetrics, 0, size)
+		for i := 0; i < size; i++ {
+			f := float64(i)
+			d := int64(i)
+			if i%2 == 0 {
+				batch = append(batch, storage.JSONMetrics{ID: fmt.Sprintf("gauge%d", i), MType: "gauge", Value: &f})
+			} else {
+				batch = append(batch, storage.JSONMetrics{ID: fmt.Sprintf("counter%d", i), MType: "counter", Delta: &d})
+			}
+		}
+		data, err := json.Marshal(batch)
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("batch %d", size), func(b *testing.B) {
+			s := storage.NewMetricsStore()
+			SetStorage(s)
+			handler := saveMetricsSlice()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(data))
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func TestDencrypt(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	SetStorage(storage.NewMetricsStore())
+	path := filepath.Join(t.TempDir(), "key")
+	_, err := crypto.GenerateKeyFiles(path, 2048)
+	require.NoError(t, err)
+	d, err := crypto.NewDecrypter(path)
+	require.NoError(t, err)
+	SetDecrypter(d)
+	defer SetDecrypter(nil)
+	encrypted, err := crypto.EncryptData([]byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`), path+".pub")
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Route("/", Router)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	tests := []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{name: "encrypted", body: encrypted, want: http.StatusOK},
+		{name: "plain", body: []byte(`[{"id":"Alloc","type":"gauge","value":2.5}]`), want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/updates/", "application/json", bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+	value, _ := StorageM.GetGauge("Alloc")
+	require.Equal(t, 1.5, value)
+}
+
+func BenchmarkUpdatesEncrypted(b *testing.B) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	config.ArgsM.Key = ""
+	path := filepath.Join(b.TempDir(), "key")
+	_, err := crypto.GenerateKeyFiles(path, 3072)
+	require.NoError(b, err)
+	batch := make([]storage.JSONMetrics, 0, 100)
+	for i := 0; i < 100; i++ {
+		f := float64(i)
+		batch = append(batch, storage.JSONMetrics{ID: fmt.Sprintf("gauge%d", i), MType: "gauge", Value: &f})
+	}
+	data, err := json.Marshal(batch)
+	require.NoError(b, err)
+	encrypted, err := crypto.EncryptData(data, path+".pub")
+	require.NoError(b, err)
+	d, err := crypto.NewDecrypter(path)
+	require.NoError(b, err)
+	defer SetDecrypter(nil)
+
+	// keys read from file for every request as before caching
+	readKeys := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			out, _ := io.ReadAll(r.Body)
+			data, err := crypto.DecryptData(out, path)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			next.ServeHTTP(w, r)
+		})
+	}
+	tests := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{name: "read keys per request", handler: readKeys(saveMetricsSlice())},
+		{name: "cached keys", handler: Dencrypt(saveMetricsSlice())},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			SetStorage(storage.NewMetricsStore())
+			SetDecrypter(d)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(encrypted))
+				w := httptest.NewRecorder()
+				tt.handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayRoutes(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	SetStorage(storage.NewMetricsStore())
+	key := []byte("key")
+	config.ArgsM.Key = string(key)
+	defer func() { config.ArgsM.Key = "" }()
+	InitConfig(config.Args{ReplayWindow: time.Minute, NonceCacheSize: 10})
+	defer InitConfig(config.Args{})
+	r := chi.NewRouter()
+	r.Route("/", Router)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	value := 1.0
+	m := storage.JSONMetrics{ID: "Alloc", MType: "gauge", Value: &value}
+	calculateHash(&m, key)
+	single, err := json.Marshal(m)
+	require.NoError(t, err)
+	batch, err := json.Marshal([]storage.JSONMetrics{m})
+	require.NoError(t, err)
+	now := time.Now().Unix()
+	tests := []struct {
+		name  string
+		url   string
+		body  []byte
+		nonce string
+		want  int
+	}{
+		{name: "update without signature#", url: "/update/", body: single, want: http.StatusUnauthorized},
+		{name: "update signed#", url: "/update/", body: single, nonce: "a", want: http.StatusOK},
+		{name: "update replayed#", url: "/update/", body: single, nonce: "a", want: http.StatusConflict},
+		// nonce of /update/ can not be used for batch
+		{name: "batch with used nonce#", url: "/updates/", body: batch, nonce: "a", want: http.StatusConflict},
+		{name: "batch signed#", url: "/updates/", body: batch, nonce: "b", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+tt.url, bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set(storage.HeaderHash, storage.HashBatch(tt.body, key))
+			if tt.nonce != "" {
+				req.Header.Set(replay.HeaderTimestamp, strconv.FormatInt(now, 10))
+				req.Header.Set(replay.HeaderNonce, tt.nonce)
+				req.Header.Set(replay.HeaderSignature, replay.Sign(key, now, tt.nonce, tt.body))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	key := []byte("key")
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	now := time.Now().Unix()
+	config.ArgsM.Key = string(key)
+	defer func() { config.ArgsM.Key = "" }()
+	handler := Replay(time.Minute, 10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, body, out)
+	}))
+	tests := []struct {
+		name      string
+		timestamp int64
+		nonce     string
+		signature string
+		want      int
+	}{
+		{name: "signed", timestamp: now, nonce: "a", want: http.StatusOK},
+		{name: "duplicate nonce", timestamp: now, nonce: "a", want: http.StatusConflict},
+		{name: "stale", timestamp: now - 120, nonce: "b", want: http.StatusConflict},
+		{name: "invalid signature", timestamp: now, nonce: "c", signature: "00", want: http.StatusUnauthorized},
+		{name: "missing headers", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			if tt.nonce != "" {
+				signature := tt.signature
+				if signature == "" {
+					signature = replay.Sign(key, tt.timestamp, tt.nonce, body)
+				}
+				req.Header.Set(replay.HeaderTimestamp, strconv.FormatInt(tt.timestamp, 10))
+				req.Header.Set(replay.HeaderNonce, tt.nonce)
+				req.Header.Set(replay.HeaderSignature, signature)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, tt.want, w.Code)
+		})
+	}
+
+	// empty nonce cache rejects batches instead of panic
+	w := httptest.NewRecorder()
+	Replay(time.Minute, 0)(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// without window or key batches are not checked
+	w = httptest.NewRecorder()
+	Replay(0, 10)(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusNotFound, w.Code)
+	config.ArgsM.Key = ""
+	w = httptest.NewRecorder()
+	Replay(time.Minute, 10)(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// Registry of agent keys in memory
+type testAgents map[string]agentkeys.Agent
+
+func (a testAgents) Key(_ context.Context, agentID string) (string, error) {
+	agent, ok := a[agentID]
+	if !ok {
+		return "", agentkeys.ErrUnknownAgent
+	}
+	if agent.Revoked {
+		return "", agentkeys.ErrRevoked
+	}
+	return agent.Key, nil
+}
+
+func TestAgentKey(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	SetAgents(testAgents{"agent-1": {Key: "k1"}, "agent-2": {Key: "k2", Revoked: true}})
+	defer SetAgents(nil)
+	r := chi.NewRouter()
+	r.Route("/", Router)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		agentID   string
+		sharedKey string
+		allow     bool
+		key       string
+		value     float64
+		want      int
+		wantValue float64
+	}{
+		{name: "agent key", agentID: "agent-1", key: "k1", value: 1, want: http.StatusOK, wantValue: 1},
+		{name: "key of other agent", agentID: "agent-1", key: "k2", value: 2, want: http.StatusBadRequest, wantValue: 1},
+		{name: "revoked", agentID: "agent-2", key: "k2", value: 3, want: http.StatusForbidden, wantValue: 1},
+		{name: "unknown", agentID: "agent-3", key: "k1", value: 4, want: http.StatusUnauthorized, wantValue: 1},
+		{name: "without ID", key: "k1", value: 5, want: http.StatusUnauthorized, wantValue: 1},
+		{name: "without ID by shared key", sharedKey: "shared", key: "shared", value: 6, want: http.StatusUnauthorized, wantValue: 1},
+		{name: "without ID by allowed shared key", sharedKey: "shared", allow: true, key: "shared", value: 7, want: http.StatusOK, wantValue: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ArgsM.Key = tt.sharedKey
+			config.ArgsM.AllowSharedKey = tt.allow
+			defer func() { config.ArgsM.Key, config.ArgsM.AllowSharedKey = "", false }()
+			value := tt.value
+			body, err := json.Marshal([]storage.JSONMetrics{{ID: "Alloc", MType: "gauge", Value: &value}})
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set(storage.HeaderHash, storage.HashBatch(body, []byte(tt.key)))
+			if tt.agentID != "" {
+				req.Header.Set(agentkeys.HeaderAgentID, tt.agentID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.want, resp.StatusCode)
+			got, _ := s.GetGauge("Alloc")
+			require.Equal(t, tt.wantValue, got)
+		})
+	}
+
+	// update by URL is not signed, so it is not checked by key of agent
+	resp, err := http.Post(ts.URL+"/update/gauge/Plain/1", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestBatchHash(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	config.ArgsM.Key = "key"
+	defer func() { config.ArgsM.Key = "" }()
+	key := []byte("key")
+	metrics := func(values ...float64) []byte {
+		batch := make([]storage.JSONMetrics, len(values))
+		for i := range values {
+			batch[i] = storage.JSONMetrics{ID: fmt.Sprintf("gauge%d", i), MType: "gauge", Value: &values[i]}
+		}
+		data, err := json.Marshal(batch)
+		require.NoError(t, err)
+		return data
+	}
+	signed := metrics(1, 2)
+	tests := []struct {
+		name      string
+		body      []byte
+		hash      string
+		want      int
+		wantSaved int
+	}{
+		{name: "signed batch", body: signed, hash: storage.HashBatch(signed, key), want: http.StatusOK, wantSaved: 2},
+		{name: "dropped metric", body: metrics(1), hash: storage.HashBatch(signed, key), want: http.StatusBadRequest},
+		{name: "wrong key", body: signed, hash: storage.HashBatch(signed, []byte("other")), want: http.StatusBadRequest},
+		// batch without hash is rejected when key is set
+		{name: "unsigned batch", body: signed, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.NewMetricsStore()
+			SetStorage(s)
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(tt.body))
+			if tt.hash != "" {
+				req.Header.Set(storage.HeaderHash, tt.hash)
+			}
+			w := httptest.NewRecorder()
+			saveMetricsSlice().ServeHTTP(w, req)
+			require.Equal(t, tt.want, w.Code)
+			saved := 0
+			for _, name := range []string{"gauge0", "gauge1"} {
+				if _, ok := s.GetGauge(name); ok {
+					saved++
+				}
+			}
+			require.Equal(t, tt.wantSaved, saved)
+		})
+	}
+}
+
+func TestSaveMetricsSliceAtomic(t *testing.T) {
+	logger, _ := zap.NewProduction()
+	InitLogger(logger)
+	s := storage.NewMetricsStore()
+	SetStorage(s)
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "invalid metric", body: `[{"id":"Batch","type":"gauge","value":1},{"id":"Alloc","type":"counter","delta":1}]`, want: http.StatusBadRequest},
+		{name: "missing value", body: `[{"id":"Batch","type":"gauge","value":1},{"id":"Other","type":"gauge"}]`, want: http.StatusBadRequest},
+		{name: "unknown type", body: `[{"id":"Batch","type":"gauge","value":1},{"id":"Other","type":"set"}]`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			saveMetricsSlice().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBufferString(tt.body)))
+			require.Equal(t, tt.want, w.Code)
+			_, ok := s.GetGauge("Batch")
+			require.False(t, ok)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error of parsing line protocol
+var ErrInvalidLine = errors.New("invalid line protocol")
+
+// Point of InfluxDB line protocol, timestamp of line is checked but not kept,
+// samples of metrics are stamped by time of receipt
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	// values are int64, uint64, float64, string or bool
+	Fields map[string]interface{}
+}
+
+// Parse points of body in line protocol, comments and empty lines are skipped
+func Parse(body []byte) ([]Point, error) {
+	var points []Point
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := ParseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		points = append(points, p)
+	}
+	return points, scanner.Err()
+}
+
+// Parse line measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func ParseLine(line string) (Point, error) {
+	var p Point
+	sections := split(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return p, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+	key := split(sections[0], ',', false)
+	p.Measurement = unescape(key[0])
+	if p.Measurement == "" {
+		return p, fmt.Errorf("%w: empty measurement", ErrInvalidLine)
+	}
+	for _, tag := range key[1:] {
+		kv := split(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			return p, fmt.Errorf("%w: tag %q", ErrInvalidLine, tag)
+		}
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[unescape(kv[0])] = unescape(kv[1])
+	}
+	p.Fields = make(map[string]interface{})
+	for _, field := range split(sections[1], ',', true) {
+		kv := split(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" {
+			return p, fmt.Errorf("%w: field %q", ErrInvalidLine, field)
+		}
+		v, err := parseValue(kv[1])
+		if err != nil {
+			return p, err
+		}
+		p.Fields[unescape(kv[0])] = v
+	}
+	if len(sections) == 3 {
+		_, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("%w: timestamp %q", ErrInvalidLine, sections[2])
+		}
+	}
+	return p, nil
+}
+
+// Parse value of field by its suffix or quotes
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("%w: empty field value", ErrInvalidLine)
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s[1 : len(s)-1]), nil
+	case s[len(s)-1] == 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: integer %q", ErrInvalidLine, s)
+		}
+		return v, nil
+	case s[len(s)-1] == 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unsigned %q", ErrInvalidLine, s)
+		}
+		return v, nil
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: float %q", ErrInvalidLine, s)
+	}
+	return v, nil
+}
+
+// Split s by separator not escaped by backslash and, if quoted is set, not inside double quotes
+func split(s string, sep byte, quoted bool) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quoted:
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+			// measurement, fields and timestamp may be separated by several spaces
+			for sep == ' ' && start < len(s) && s[start] == ' ' {
+				start++
+				i++
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Remove escaping backslashes of names and tag values
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, `,`, `\ `, ` `, `\=`, `=`, `\"`, `"`, `\\`, `\`).Replace(s)
+}
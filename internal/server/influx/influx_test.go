@@ -0,0 +1,66 @@
+package influx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Point
+		wantErr bool
+	}{
+		{
+			name: "full line",
+			line: "cpu,host=web1,region=eu usage=0.64,procs=12i 1700000000000000000",
+			want: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "web1", "region": "eu"},
+				Fields:      map[string]interface{}{"usage": 0.64, "procs": int64(12)},
+			},
+		},
+		{
+			name: "without tags and timestamp",
+			line: "mem free=3u,ok=true",
+			want: Point{Measurement: "mem", Fields: map[string]interface{}{"free": uint64(3), "ok": true}},
+		},
+		{
+			name: "escaping and strings",
+			line: `disk\ io,path=/var\,log msg="a b, \"c\"",read=1`,
+			want: Point{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": "/var,log"},
+				Fields:      map[string]interface{}{"msg": `a b, "c"`, "read": float64(1)},
+			},
+		},
+		{name: "without fields", line: "cpu", wantErr: true},
+		{name: "bad integer", line: "cpu procs=1.5i", wantErr: true},
+		{name: "bad float", line: "cpu usage=high", wantErr: true},
+		{name: "bad tag", line: "cpu,host usage=1", wantErr: true},
+		{name: "bad timestamp", line: "cpu usage=1 now", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseLine(tt.line)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, p)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	points, err := Parse([]byte("# comment\ncpu usage=1\n\nmem free=2i\n"))
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+
+	_, err = Parse([]byte("cpu usage=1\nmem free=two\n"))
+	require.ErrorIs(t, err, ErrInvalidLine)
+	require.Contains(t, err.Error(), "line 2")
+}
@@ -0,0 +1,286 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/AlekseyKas/metrics/internal/proto"
+	"github.com/AlekseyKas/metrics/internal/replay"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// gRPC service saving metrics in storage
+type Server struct {
+	pb.UnimplementedMetricsServer
+	storage storage.Storage
+	key     []byte
+	trusted *net.IPNet
+	tls     *tls.Config
+	agents  agentkeys.Registry
+	shared  bool
+	guard   *replay.Guard
+	logger  *zap.Logger
+}
+
+// Create service, metrics are checked by HMAC if key is set
+func NewServer(s storage.Storage, key string, logger *zap.Logger) *Server {
+	return &Server{
+		storage: s,
+		key:     []byte(key),
+		logger:  logger,
+	}
+}
+
+// Reject calls from addresses outside of subnet, every address is trusted if subnet is empty
+func (s *Server) SetTrustedSubnet(subnet string) error {
+	if subnet == "" {
+		s.trusted = nil
+		return nil
+	}
+	_, trusted, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	s.trusted = trusted
+	return nil
+}
+
+// Check metrics by keys of agents from registry, shared key is used if registry is nil
+func (s *Server) SetAgents(r agentkeys.Registry) {
+	s.agents = r
+}
+
+// Accept calls without agent ID by shared key when registry is set, they are rejected by default
+func (s *Server) SetAllowSharedKey(allow bool) {
+	s.shared = allow
+}
+
+// Reject calls with invalid signature of timestamp and nonce, stale timestamp or used nonce,
+// calls are not checked if window is zero or key of agent is empty
+func (s *Server) SetReplay(window time.Duration, size int) error {
+	if window <= 0 {
+		s.guard = nil
+		return nil
+	}
+	guard, err := replay.NewGuard(window, size)
+	if err != nil {
+		return err
+	}
+	s.guard = guard
+	return nil
+}
+
+// Serve gRPC over TLS, connections are not encrypted if config is nil
+func (s *Server) SetTLS(cfg *tls.Config) {
+	s.tls = cfg
+}
+
+// Options of gRPC server with interceptors of service
+func (s *Server) options() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := s.checkSubnet(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.checkSubnet(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if s.tls != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tls)))
+	}
+	return opts
+}
+
+// Check address of client from x-real-ip metadata or peer address
+func (s *Server) checkSubnet(ctx context.Context) error {
+	if s.trusted == nil {
+		return nil
+	}
+	var ip string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-real-ip"); len(v) > 0 {
+			ip = v[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && ip == "" {
+		ip, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil || !s.trusted.Contains(addr) {
+		return status.Error(codes.PermissionDenied, "address is not in trusted subnet")
+	}
+	return nil
+}
+
+// Listen TCP address and serve gRPC until context is done
+func ListenAndServe(ctx context.Context, addr string, s *Server) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(s.options()...)
+	pb.RegisterMetricsServer(srv, s)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	s.logger.Info("gRPC server started", zap.String("address", l.Addr().String()))
+	return srv.Serve(l)
+}
+
+// Save batch of metrics
+func (s *Server) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	key, err := s.agentKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkReplay(ctx, key, req.GetMetrics())
+	if err != nil {
+		return nil, err
+	}
+	saved, err := s.save(key, req.GetMetrics())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricsResponse{Saved: saved}, nil
+}
+
+// Receive batches of metrics until client closes stream and save them in one batch,
+// so failed stream saves nothing and agent can send it again
+func (s *Server) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	key, err := s.agentKey(stream.Context())
+	if err != nil {
+		return err
+	}
+	var metrics []*pb.Metric
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, req.GetMetrics()...)
+	}
+	err = s.checkReplay(stream.Context(), key, metrics)
+	if err != nil {
+		return err
+	}
+	saved, err := s.save(key, metrics)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.UpdateMetricsResponse{Saved: saved})
+}
+
+// Key of agent from x-agent-id metadata by registry, calls without ID are rejected
+// unless shared key is set and allowed for them
+func (s *Server) agentKey(ctx context.Context) ([]byte, error) {
+	if s.agents == nil {
+		return s.key, nil
+	}
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(agentkeys.MetadataAgentID); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	if id == "" {
+		if len(s.key) == 0 || !s.shared {
+			return nil, status.Error(codes.Unauthenticated, "agent ID is missing")
+		}
+		return s.key, nil
+	}
+	key, err := s.agents.Key(ctx, id)
+	switch {
+	case errors.Is(err, agentkeys.ErrRevoked):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, agentkeys.ErrUnknownAgent):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		s.logger.Error("Error getting key of agent: ", zap.String("agent", id), zap.Error(err))
+		return nil, status.Error(codes.Internal, "error getting key of agent")
+	}
+	return []byte(key), nil
+}
+
+// Check signature of timestamp and nonce from metadata over all metrics of call and remember nonce
+func (s *Server) checkReplay(ctx context.Context, key []byte, metrics []*pb.Metric) error {
+	if s.guard == nil || len(key) == 0 {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(k string) string {
+		if v := md.Get(k); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	body, err := pb.SignedBody(metrics)
+	if err != nil {
+		s.logger.Error("Error marshaling metrics: ", zap.Error(err))
+		return status.Error(codes.Internal, "error checking signature")
+	}
+	nonce := get(replay.MetadataNonce)
+	ts, err := replay.Verify(key, get(replay.MetadataTimestamp), nonce, get(replay.MetadataSignature), body)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	err = s.guard.Check(ts, nonce, time.Now())
+	switch {
+	case errors.Is(err, replay.ErrDuplicate):
+		s.logger.Info("Call is rejected: ", zap.Error(err))
+		return status.Error(codes.AlreadyExists, err.Error())
+	case err != nil:
+		s.logger.Info("Call is rejected: ", zap.Error(err))
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return nil
+}
+
+// Save metrics in one batch like /updates/ handler, metric with wrong hash rejects whole call
+func (s *Server) save(key []byte, metrics []*pb.Metric) (int64, error) {
+	batch := make([]storage.JSONMetrics, 0, len(metrics))
+	for _, p := range metrics {
+		m := p.JSON()
+		if len(key) > 0 {
+			hash, err := storage.Hash(&m, key)
+			if err != nil || hash != m.Hash {
+				s.logger.Error("Error compare hash of metrics: ", zap.String("id", m.ID), zap.Error(err))
+				return 0, status.Errorf(codes.InvalidArgument, "invalid hash of metric %s", m.ID)
+			}
+		}
+		batch = append(batch, m)
+	}
+	err := s.storage.UpdateBatch(batch)
+	switch {
+	case err == nil:
+		return int64(len(batch)), nil
+	case errors.Is(err, storage.ErrMissingValue), errors.Is(err, storage.ErrUnknownType), storage.IsInvalidMetric(err):
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	default:
+		s.logger.Error("Error saving batch of metrics: ", zap.Error(err))
+		return 0, status.Error(codes.Internal, "error saving metrics")
+	}
+}
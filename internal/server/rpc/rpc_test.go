@@ -0,0 +1,315 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/AlekseyKas/metrics/internal/proto"
+	"github.com/AlekseyKas/metrics/internal/replay"
+	"github.com/AlekseyKas/metrics/internal/server/agentkeys"
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// Start service on buffer and connect client to it
+func newClient(t *testing.T, s *Server) pb.MetricsClient {
+	l := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(s.options()...)
+	pb.RegisterMetricsServer(srv, s)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	value := 1.5
+	delta := int64(2)
+	signed := storage.JSONMetrics{ID: "Alloc", MType: "gauge", Value: &value}
+	hash, err := storage.Hash(&signed, []byte("key"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		key       string
+		metrics   []*pb.Metric
+		wantSaved int64
+		wantCode  codes.Code
+	}{
+		{
+			name: "save",
+			metrics: []*pb.Metric{
+				{Id: "Alloc", Type: "gauge", Value: &value},
+				{Id: "Hits", Type: "counter", Delta: &delta, Labels: map[string]string{"host": "a"}},
+			},
+			wantSaved: 2,
+		},
+		{
+			name:      "signed",
+			key:       "key",
+			metrics:   []*pb.Metric{{Id: "Alloc", Type: "gauge", Value: &value, Hash: hash}},
+			wantSaved: 1,
+		},
+		{
+			name: "wrong hash rejects call",
+			key:  "key",
+			metrics: []*pb.Metric{
+				{Id: "Alloc", Type: "gauge", Value: &value, Hash: hash},
+				{Id: "Alloc", Type: "gauge", Value: &value, Hash: "wrong"},
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "type mismatch",
+			metrics:  []*pb.Metric{{Id: "PollCount", Type: "gauge", Value: &value}},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.NewMetricsStore()
+			client := newClient(t, NewServer(s, tt.key, zap.NewNop()))
+			resp, err := client.UpdateMetrics(context.Background(), &pb.UpdateMetricsRequest{Metrics: tt.metrics})
+			if tt.wantCode != codes.OK {
+				require.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSaved, resp.GetSaved())
+			v, _ := s.GetGauge("Alloc")
+			require.Equal(t, value, v)
+		})
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	s := storage.NewMetricsStore()
+	client := newClient(t, NewServer(s, "", zap.NewNop()))
+	stream, err := client.StreamMetrics(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		delta := int64(i + 1)
+		require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Hits", Type: "counter", Delta: &delta}}}))
+	}
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), resp.GetSaved())
+	v, _ := s.GetCounter("Hits")
+	require.Equal(t, int64(6), v)
+}
+
+func TestStreamMetricsAtomic(t *testing.T) {
+	s := storage.NewMetricsStore()
+	client := newClient(t, NewServer(s, "", zap.NewNop()))
+	stream, err := client.StreamMetrics(context.Background())
+	require.NoError(t, err)
+	delta := int64(1)
+	value := 1.5
+	require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Hits", Type: "counter", Delta: &delta}}}))
+	// invalid metric in later message rejects metrics of whole stream
+	require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "PollCount", Type: "gauge", Value: &value}}}))
+	_, err = stream.CloseAndRecv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, ok := s.GetCounter("Hits")
+	require.False(t, ok)
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	value := 1.5
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Alloc", Type: "gauge", Value: &value}}}
+	tests := []struct {
+		name     string
+		subnet   string
+		realIP   string
+		wantCode codes.Code
+	}{
+		{name: "without subnet", wantCode: codes.OK},
+		{name: "trusted address", subnet: "192.168.1.0/24", realIP: "192.168.1.10", wantCode: codes.OK},
+		{name: "untrusted address", subnet: "192.168.1.0/24", realIP: "10.0.0.1", wantCode: codes.PermissionDenied},
+		{name: "without address", subnet: "192.168.1.0/24", wantCode: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(storage.NewMetricsStore(), "", zap.NewNop())
+			require.NoError(t, s.SetTrustedSubnet(tt.subnet))
+			client := newClient(t, s)
+			ctx := context.Background()
+			if tt.realIP != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-real-ip", tt.realIP)
+			}
+			_, err := client.UpdateMetrics(ctx, req)
+			require.Equal(t, tt.wantCode, status.Code(err))
+			stream, err := client.StreamMetrics(ctx)
+			require.NoError(t, err)
+			_, err = stream.CloseAndRecv()
+			require.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+	require.Error(t, NewServer(nil, "", zap.NewNop()).SetTrustedSubnet("192.168.1.0"))
+}
+
+func TestTLS(t *testing.T) {
+	// certificate of test server is valid for 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	s := NewServer(storage.NewMetricsStore(), "", zap.NewNop())
+	s.SetTLS(ts.TLS)
+	l := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(s.options()...)
+	pb.RegisterMetricsServer(srv, s)
+	go srv.Serve(l)
+	defer srv.Stop()
+	dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) })
+	value := 1.5
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Alloc", Type: "gauge", Value: &value}}}
+
+	conn, err := grpc.Dial("127.0.0.1", dialer, grpc.WithTransportCredentials(credentials.NewTLS(ts.Client().Transport.(*http.Transport).TLSClientConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err := pb.NewMetricsClient(conn).UpdateMetrics(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), resp.GetSaved())
+
+	plain, err := grpc.Dial("127.0.0.1", dialer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = pb.NewMetricsClient(plain).UpdateMetrics(context.Background(), req)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestAgentKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"agent-1":{"key":"k1"},"agent-2":{"key":"k2","revoked":true}}`), 0600))
+	agents, err := agentkeys.NewFileRegistry(path)
+	require.NoError(t, err)
+	value := 1.5
+	m := storage.JSONMetrics{ID: "Alloc", MType: "gauge", Value: &value}
+	tests := []struct {
+		name      string
+		agentID   string
+		sharedKey string
+		key       string
+		allow     bool
+		wantCode  codes.Code
+		wantSaved int64
+	}{
+		{name: "agent key", agentID: "agent-1", key: "k1", wantCode: codes.OK, wantSaved: 1},
+		{name: "key of other agent", agentID: "agent-1", key: "k2", wantCode: codes.InvalidArgument},
+		{name: "revoked", agentID: "agent-2", wantCode: codes.PermissionDenied},
+		{name: "unknown", agentID: "agent-3", wantCode: codes.Unauthenticated},
+		{name: "without ID", wantCode: codes.Unauthenticated},
+		{name: "without ID by shared key", sharedKey: "shared", wantCode: codes.Unauthenticated},
+		{name: "without ID by allowed shared key", sharedKey: "shared", key: "shared", allow: true, wantCode: codes.OK, wantSaved: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(storage.NewMetricsStore(), tt.sharedKey, zap.NewNop())
+			s.SetAgents(agents)
+			s.SetAllowSharedKey(tt.allow)
+			client := newClient(t, s)
+			ctx := context.Background()
+			if tt.agentID != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, agentkeys.MetadataAgentID, tt.agentID)
+			}
+			hash, err := storage.Hash(&m, []byte(tt.key))
+			require.NoError(t, err)
+			req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{{Id: "Alloc", Type: "gauge", Value: &value, Hash: hash}}}
+			resp, err := client.UpdateMetrics(ctx, req)
+			require.Equal(t, tt.wantCode, status.Code(err))
+			require.Equal(t, tt.wantSaved, resp.GetSaved())
+			stream, err := client.StreamMetrics(ctx)
+			require.NoError(t, err)
+			// stream closed by server gives EOF, status of call is got by CloseAndRecv
+			err = stream.Send(req)
+			if err != nil {
+				require.ErrorIs(t, err, io.EOF)
+			}
+			_, err = stream.CloseAndRecv()
+			require.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	key := []byte("key")
+	value := 1.5
+	m := storage.JSONMetrics{ID: "Alloc", MType: "gauge", Value: &value}
+	hash, err := storage.Hash(&m, key)
+	require.NoError(t, err)
+	metrics := []*pb.Metric{{Id: "Alloc", Type: "gauge", Value: &value, Hash: hash}}
+	body, err := pb.SignedBody(metrics)
+	require.NoError(t, err)
+	now := time.Now().Unix()
+
+	s := NewServer(storage.NewMetricsStore(), string(key), zap.NewNop())
+	require.NoError(t, s.SetReplay(time.Minute, 10))
+	client := newClient(t, s)
+	tests := []struct {
+		name      string
+		stream    bool
+		timestamp int64
+		nonce     string
+		signature string
+		wantCode  codes.Code
+	}{
+		{name: "signed", timestamp: now, nonce: "a", wantCode: codes.OK},
+		{name: "duplicate nonce", timestamp: now, nonce: "a", wantCode: codes.AlreadyExists},
+		{name: "duplicate nonce in stream", stream: true, timestamp: now, nonce: "a", wantCode: codes.AlreadyExists},
+		{name: "signed stream", stream: true, timestamp: now, nonce: "b", wantCode: codes.OK},
+		{name: "stale", timestamp: now - 120, nonce: "c", wantCode: codes.FailedPrecondition},
+		{name: "invalid signature", timestamp: now, nonce: "d", signature: "00", wantCode: codes.Unauthenticated},
+		{name: "missing metadata", wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.nonce != "" {
+				signature := tt.signature
+				if signature == "" {
+					signature = replay.Sign(key, tt.timestamp, tt.nonce, body)
+				}
+				ctx = metadata.AppendToOutgoingContext(ctx,
+					replay.MetadataTimestamp, strconv.FormatInt(tt.timestamp, 10),
+					replay.MetadataNonce, tt.nonce,
+					replay.MetadataSignature, signature)
+			}
+			if !tt.stream {
+				_, err := client.UpdateMetrics(ctx, &pb.UpdateMetricsRequest{Metrics: metrics})
+				require.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+			stream, err := client.StreamMetrics(ctx)
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: metrics}))
+			_, err = stream.CloseAndRecv()
+			require.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+
+	require.Error(t, NewServer(nil, "", zap.NewNop()).SetReplay(time.Minute, 0))
+}
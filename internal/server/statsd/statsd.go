@@ -0,0 +1,152 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+// Max size of UDP datagram
+const maxPacketSize = 65535
+
+// Errors of parsing StatsD line
+var (
+	ErrInvalidLine = errors.New("invalid statsd line")
+	ErrUnknownType = errors.New("unknown statsd metric type")
+)
+
+// Metric of StatsD line protocol
+type Metric struct {
+	Name       string
+	Type       string
+	Value      float64
+	SampleRate float64
+	// gauge value with sign is added to current value
+	Relative bool
+	Labels   map[string]string
+}
+
+// Listen UDP address and save metrics in storage until context is done
+func ListenAndServe(ctx context.Context, addr string, s storage.Storage, logger *zap.Logger) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("StatsD listener started", zap.String("address", conn.LocalAddr().String()))
+	return Serve(ctx, conn, s, logger)
+}
+
+// Read packets from connection and save metrics in storage until context is done
+func Serve(ctx context.Context, conn net.PacketConn, s storage.Storage, logger *zap.Logger) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			err = SaveLine(s, line)
+			if err != nil {
+				logger.Error("Error saving statsd metric: ", zap.String("line", line), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Parse line and save metric in storage
+func SaveLine(s storage.Storage, line string) error {
+	m, err := ParseLine(line)
+	if err != nil {
+		return err
+	}
+	key := storage.MetricKey(m.Name, m.Labels)
+	switch m.Type {
+	case "c":
+		_, err = s.UpdateCounter(key, int64(math.Round(m.Value/m.SampleRate)))
+		return err
+	case "g":
+		// relative gauge is changed in storage under its lock, so concurrent packets are not lost
+		if m.Relative {
+			_, err = s.AddGauge(key, m.Value)
+			return err
+		}
+		return s.UpdateGauge(key, m.Value)
+	case "ms", "h", "d":
+		return s.ObserveSummary(key, []float64{m.Value})
+	}
+	return ErrUnknownType
+}
+
+// Parse line of StatsD protocol name:value|type[|@rate][|#tag:value,...]
+func ParseLine(line string) (Metric, error) {
+	m := Metric{SampleRate: 1}
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return m, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+	// tags may contain colons, value is between last colon and first pipe
+	i := strings.LastIndex(line[:pipe], ":")
+	if i <= 0 {
+		return m, fmt.Errorf("%w: %q", ErrInvalidLine, line)
+	}
+	m.Name = line[:i]
+	parts := strings.Split(line[i+1:], "|")
+	value := parts[0]
+	m.Type = parts[1]
+	switch m.Type {
+	case "c", "g", "ms", "h", "d":
+	default:
+		return m, fmt.Errorf("%w: %q", ErrUnknownType, m.Type)
+	}
+	m.Relative = m.Type == "g" && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-"))
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return m, fmt.Errorf("%w: value %q", ErrInvalidLine, value)
+	}
+	m.Value = v
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, fmt.Errorf("%w: sample rate %q", ErrInvalidLine, p)
+			}
+			m.SampleRate = rate
+		case strings.HasPrefix(p, "#"):
+			m.Labels = parseTags(p[1:])
+		}
+	}
+	return m, nil
+}
+
+// Parse tags tag:value,tag as labels
+func parseTags(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(tag, ":")
+		labels[name] = value
+	}
+	return labels
+}
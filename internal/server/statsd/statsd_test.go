@@ -0,0 +1,109 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/storage"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Metric
+		wantErr error
+	}{
+		{name: "counter", line: "hits:1|c", want: Metric{Name: "hits", Type: "c", Value: 1, SampleRate: 1}},
+		{name: "gauge", line: "temp:3.2|g", want: Metric{Name: "temp", Type: "g", Value: 3.2, SampleRate: 1}},
+		{name: "relative gauge", line: "temp:-2|g", want: Metric{Name: "temp", Type: "g", Value: -2, SampleRate: 1, Relative: true}},
+		{name: "timer with rate", line: "req.time:320|ms|@0.1", want: Metric{Name: "req.time", Type: "ms", Value: 320, SampleRate: 0.1}},
+		{
+			name: "tags",
+			line: "hits:2|c|@0.5|#host:a,env",
+			want: Metric{Name: "hits", Type: "c", Value: 2, SampleRate: 0.5, Labels: map[string]string{"host": "a", "env": ""}},
+		},
+		{name: "without type", line: "hits:1", wantErr: ErrInvalidLine},
+		{name: "without value", line: "hits|c", wantErr: ErrInvalidLine},
+		{name: "bad value", line: "hits:one|c", wantErr: ErrInvalidLine},
+		{name: "bad rate", line: "hits:1|c|@2", wantErr: ErrInvalidLine},
+		{name: "set", line: "users:42|s", wantErr: ErrUnknownType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseLine(tt.line)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, m)
+		})
+	}
+}
+
+func TestSaveLine(t *testing.T) {
+	s := storage.NewMetricsStore()
+	for _, line := range []string{"hits:1|c", "hits:2|c|@0.5", "temp:10|g", "temp:+2.5|g", "req:30|ms", "Alloc:1|c"} {
+		err := SaveLine(s, line)
+		if line == "Alloc:1|c" {
+			require.ErrorIs(t, err, storage.ErrTypeMismatch)
+			continue
+		}
+		require.NoError(t, err)
+	}
+	hits, _ := s.GetCounter("hits")
+	require.Equal(t, int64(5), hits)
+	temp, _ := s.GetGauge("temp")
+	require.Equal(t, 12.5, temp)
+	req, ok := s.GetSummary("req")
+	require.True(t, ok)
+	require.Equal(t, int64(1), req.Count)
+}
+
+func TestSaveLineRelativeConcurrent(t *testing.T) {
+	s := storage.NewMetricsStore()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, SaveLine(s, "queue:+1|g"))
+		}()
+	}
+	wg.Wait()
+	queue, _ := s.GetGauge("queue")
+	require.Equal(t, float64(100), queue)
+}
+
+func TestServe(t *testing.T) {
+	s := storage.NewMetricsStore()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ctx, conn, s, zap.NewNop())
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hits:3|c|#host:a\nbroken\ntemp:1.5|g\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		hits, ok := s.GetCounter(storage.MetricKey("hits", map[string]string{"host": "a"}))
+		_, okTemp := s.GetGauge("temp")
+		return ok && okTemp && hits == 3
+	}, time.Second, time.Millisecond*10)
+
+	cancel()
+	require.NoError(t, <-done)
+}
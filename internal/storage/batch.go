@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// Value of metric after update in batch, written to database
+type batchRow struct {
+	key   string
+	mType string
+	value float64
+	delta int64
+	hist  Histogram
+}
+
+// Save batch of metrics, batch is checked before saving, so one invalid metric rejects whole batch
+func (m *MetricsStore) UpdateBatch(metrics []JSONMetrics) error {
+	m.batch.Lock()
+	defer m.batch.Unlock()
+	_, err := m.prepareBatch(metrics)
+	if err != nil {
+		return err
+	}
+	return m.applyBatch(metrics)
+}
+
+// Check batch against stored metrics and calculate values after every update without changing storage
+func (m *MetricsStore) prepareBatch(metrics []JSONMetrics) ([]batchRow, error) {
+	state := make(map[string]metric)
+	rows := make([]batchRow, 0, len(metrics))
+	for i := range metrics {
+		j := &metrics[i]
+		key := MetricKey(j.ID, j.Labels)
+		cur, ok := state[key]
+		if !ok {
+			cur, ok = m.reg.get(key)
+		}
+		if ok && cur.mType != j.MType {
+			return nil, fmt.Errorf("%s: %w", j.ID, ErrTypeMismatch)
+		}
+		switch j.MType {
+		case "gauge":
+			if j.Value == nil {
+				return nil, fmt.Errorf("%s: %w", j.ID, ErrMissingValue)
+			}
+			cur = metric{mType: "gauge", value: *j.Value}
+			rows = append(rows, batchRow{key: key, mType: "gauge", value: cur.value})
+		case "counter":
+			if j.Delta == nil {
+				return nil, fmt.Errorf("%s: %w", j.ID, ErrMissingValue)
+			}
+			cur = metric{mType: "counter", delta: cur.delta + *j.Delta}
+			rows = append(rows, batchRow{key: key, mType: "counter", delta: cur.delta})
+		case "histogram":
+			h, found := j.Histogram()
+			if !found {
+				return nil, fmt.Errorf("%s: %w", j.ID, ErrMissingValue)
+			}
+			err := h.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", j.ID, err)
+			}
+			if ok {
+				h, err = cur.hist.merge(h)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", j.ID, err)
+				}
+			} else {
+				h = h.clone()
+			}
+			cur = metric{mType: "histogram", hist: h}
+			rows = append(rows, batchRow{key: key, mType: "histogram", hist: h})
+		case "summary":
+			if len(j.Observations) == 0 {
+				return nil, fmt.Errorf("%s: %w", j.ID, ErrMissingValue)
+			}
+			// summaries are kept in memory only
+			cur = metric{mType: "summary"}
+		default:
+			return nil, fmt.Errorf("%s: %w", j.ID, ErrUnknownType)
+		}
+		state[key] = cur
+	}
+	return rows, nil
+}
+
+// Save checked batch in memory
+func (m *MetricsStore) applyBatch(metrics []JSONMetrics) error {
+	for i := range metrics {
+		err := SaveMetric(m, &metrics[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save batch, write file when storing is synchronous
+func (f *FileStorage) UpdateBatch(metrics []JSONMetrics) error {
+	err := f.MetricsStore.UpdateBatch(metrics)
+	if err != nil || f.interval > 0 {
+		return err
+	}
+	return f.Flush()
+}
+
+// Save batch in one transaction of database, memory is updated only after commit.
+// Batches are serialized, so totals of counters written to database are not lost by concurrent batches
+func (p *PostgresStorage) UpdateBatch(metrics []JSONMetrics) error {
+	p.batch.Lock()
+	defer p.batch.Unlock()
+	rows, err := p.prepareBatch(metrics)
+	if err != nil {
+		return err
+	}
+	err = p.writeRows(rows)
+	if err != nil {
+		return err
+	}
+	return p.applyBatch(metrics)
+}
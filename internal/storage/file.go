@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/config"
+)
+
+// Storage in memory synced with JSON file
+type FileStorage struct {
+	*MetricsStore
+	path     string
+	interval time.Duration
+	mux      sync.Mutex
+}
+
+// Create file storage, restore metrics from file and start syncing
+func NewFileStorage(ctx context.Context, params config.Args) (*FileStorage, error) {
+	f := &FileStorage{
+		MetricsStore: NewMetricsStore(),
+		path:         params.StoreFile,
+		interval:     params.StoreInterval,
+	}
+	f.SetSeriesLimit(params.SeriesLimit)
+	if params.Restore {
+		err := f.Load()
+		if err != nil {
+			Logger.Error("Error restore metrics from file: ", zap.Error(err))
+		}
+	}
+	if f.interval > 0 {
+		go f.sync(ctx)
+	}
+	return f, nil
+}
+
+// Load metrics from file, missing file is not an error
+func (f *FileStorage) Load() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		Logger.Error("Error read file: ", zap.Error(err))
+		return err
+	}
+	return f.loadMetricsJSON(data)
+}
+
+// Write all metrics to file
+func (f *FileStorage) Flush() error {
+	metrics, err := f.GetMetricsJSON()
+	if err != nil {
+		Logger.Error("Error getting metrics format JSON GetMetricsJSON: ", zap.Error(err))
+		return err
+	}
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		Logger.Error("Error marshaling metrics : ", zap.Error(err))
+		return err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	// Write to temporary file and rename, so readers never see partial data
+	tmp := f.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0777)
+	if err != nil {
+		Logger.Error("Error write metrics to file : ", zap.Error(err))
+		return err
+	}
+	err = os.Rename(tmp, f.path)
+	if err != nil {
+		Logger.Error("Error rename file of metrics : ", zap.Error(err))
+	}
+	return err
+}
+
+// Update gauge, write file when storing is synchronous
+func (f *FileStorage) UpdateGauge(nameMet string, value float64) error {
+	err := f.MetricsStore.UpdateGauge(nameMet, value)
+	if err != nil || f.interval > 0 {
+		return err
+	}
+	return f.Flush()
+}
+
+// Add delta to gauge, write file when storing is synchronous
+func (f *FileStorage) AddGauge(nameMet string, delta float64) (float64, error) {
+	value, err := f.MetricsStore.AddGauge(nameMet, delta)
+	if err != nil || f.interval > 0 {
+		return value, err
+	}
+	return value, f.Flush()
+}
+
+// Add delta to counter, write file when storing is synchronous
+func (f *FileStorage) UpdateCounter(nameMet string, delta int64) (int64, error) {
+	value, err := f.MetricsStore.UpdateCounter(nameMet, delta)
+	if err != nil || f.interval > 0 {
+		return value, err
+	}
+	return value, f.Flush()
+}
+
+// Merge histogram, write file when storing is synchronous
+func (f *FileStorage) UpdateHistogram(nameMet string, h Histogram) (Histogram, error) {
+	merged, err := f.MetricsStore.UpdateHistogram(nameMet, h)
+	if err != nil || f.interval > 0 {
+		return merged, err
+	}
+	return merged, f.Flush()
+}
+
+// Write metrics to file on close
+func (f *FileStorage) Close() error {
+	return f.Flush()
+}
+
+// Write metrics to file every interval
+func (f *FileStorage) sync(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			Logger.Info("File syncing is down")
+			return
+		case <-ticker.C:
+			err := f.Flush()
+			if err != nil {
+				Logger.Error("Error syncing metrics with file: ", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors of metric in JSON format
+var (
+	ErrMissingValue = errors.New("metric value is missing")
+	ErrUnknownType  = errors.New("unknown metric type")
+)
+
+// Data of metric signed by HMAC
+func HashData(m *JSONMetrics) (string, error) {
+	key := MetricKey(m.ID, m.Labels)
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return "", ErrMissingValue
+		}
+		return fmt.Sprintf("%s:counter:%d", key, *m.Delta), nil
+	case "gauge":
+		if m.Value == nil {
+			return "", ErrMissingValue
+		}
+		return fmt.Sprintf("%s:gauge:%f", key, *m.Value), nil
+	case "histogram":
+		if m.Sum == nil || m.Count == nil {
+			return "", ErrMissingValue
+		}
+		var b strings.Builder
+		for i, bucket := range m.Buckets {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%f=%d", bucket.UpperBound, bucket.Count)
+		}
+		return fmt.Sprintf("%s:histogram:%s:%f:%d", key, b.String(), *m.Sum, *m.Count), nil
+	case "summary":
+		var b strings.Builder
+		if len(m.Observations) > 0 {
+			for i, v := range m.Observations {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%f", v)
+			}
+			return fmt.Sprintf("%s:summary:%s", key, b.String()), nil
+		}
+		if m.Sum == nil || m.Count == nil {
+			return "", ErrMissingValue
+		}
+		for i, q := range m.Quantiles {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%f=%f", q.Quantile, q.Value)
+		}
+		return fmt.Sprintf("%s:summary:%s:%f:%d", key, b.String(), *m.Sum, *m.Count), nil
+	}
+	return "", ErrUnknownType
+}
+
+// HMAC-SHA256 of metric data in hex
+func Hash(m *JSONMetrics, key []byte) (string, error) {
+	data, err := HashData(m)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Header with HMAC-SHA256 of batch of metrics
+const HeaderHash = "HashSHA256"
+
+// HMAC-SHA256 of uncompressed JSON body of batch in hex
+func HashBatch(body []byte, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Check HMAC-SHA256 of batch body
+func CheckBatch(body []byte, key []byte, hash string) bool {
+	return hmac.Equal([]byte(HashBatch(body, key)), []byte(hash))
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"math"
+)
+
+// Errors of histogram buckets
+var (
+	ErrBucketsMismatch  = errors.New("histogram buckets do not match stored ones")
+	ErrInvalidHistogram = errors.New("histogram buckets must have increasing bounds and counts")
+)
+
+// Bucket of histogram, count of observations less or equal to upper bound
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      int64   `json:"count"`
+}
+
+// Histogram of observations with cumulative buckets
+type Histogram struct {
+	Buckets []Bucket `json:"buckets"`
+	Sum     float64  `json:"sum"`
+	Count   int64    `json:"count"`
+}
+
+// Check bounds and counts of buckets
+func (h Histogram) Validate() error {
+	if h.Count < 0 {
+		return ErrInvalidHistogram
+	}
+	for i, b := range h.Buckets {
+		if math.IsNaN(b.UpperBound) || b.Count < 0 || b.Count > h.Count {
+			return ErrInvalidHistogram
+		}
+		if i > 0 && (b.UpperBound <= h.Buckets[i-1].UpperBound || b.Count < h.Buckets[i-1].Count) {
+			return ErrInvalidHistogram
+		}
+	}
+	return nil
+}
+
+// Add observations of histogram with the same buckets
+func (h Histogram) merge(o Histogram) (Histogram, error) {
+	if len(h.Buckets) != len(o.Buckets) {
+		return Histogram{}, ErrBucketsMismatch
+	}
+	merged := Histogram{
+		Buckets: make([]Bucket, len(h.Buckets)),
+		Sum:     h.Sum + o.Sum,
+		Count:   h.Count + o.Count,
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i].UpperBound != o.Buckets[i].UpperBound {
+			return Histogram{}, ErrBucketsMismatch
+		}
+		merged.Buckets[i] = Bucket{
+			UpperBound: h.Buckets[i].UpperBound,
+			Count:      h.Buckets[i].Count + o.Buckets[i].Count,
+		}
+	}
+	return merged, nil
+}
+
+// Copy of histogram not sharing buckets
+func (h Histogram) clone() Histogram {
+	h.Buckets = append([]Bucket(nil), h.Buckets...)
+	return h
+}
+
+// Histogram of metric in JSON format, false if sum or count is missing
+func (j *JSONMetrics) Histogram() (Histogram, bool) {
+	if j.Sum == nil || j.Count == nil {
+		return Histogram{}, false
+	}
+	return Histogram{
+		Buckets: append([]Bucket(nil), j.Buckets...),
+		Sum:     *j.Sum,
+		Count:   *j.Count,
+	}, true
+}
+
+// Set fields of histogram in metric of JSON format
+func (j *JSONMetrics) SetHistogram(h Histogram) {
+	sum := h.Sum
+	count := h.Count
+	j.Buckets = append([]Bucket(nil), h.Buckets...)
+	j.Sum = &sum
+	j.Count = &count
+}
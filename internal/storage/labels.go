@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Key of metric in storage built from its ID and labels, e.g. Alloc{host="a"}
+func MetricKey(id string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return id
+	}
+	return id + "{" + FormatLabels(labels) + "}"
+}
+
+// Labels in canonical form: sorted by name, values quoted
+func FormatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	return b.String()
+}
+
+// Split key of metric to ID and labels
+func ParseMetricKey(key string) (string, map[string]string) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	labels, ok := ParseLabels(key[i+1 : len(key)-1])
+	if !ok {
+		return key, nil
+	}
+	return key[:i], labels
+}
+
+// Parse labels in canonical form made by FormatLabels
+func ParseLabels(s string) (map[string]string, bool) {
+	if s == "" {
+		return nil, true
+	}
+	labels := make(map[string]string)
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		name := s[:eq]
+		quoted, err := strconv.QuotedPrefix(s[eq+1:])
+		if err != nil {
+			return nil, false
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, false
+		}
+		labels[name] = value
+		s = s[eq+1+len(quoted):]
+		if s != "" {
+			if s[0] != ',' {
+				return nil, false
+			}
+			s = s[1:]
+		}
+	}
+	return labels, true
+}
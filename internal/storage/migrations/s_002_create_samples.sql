@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS samples (id VARCHAR NOT NULL, metric_type VARCHAR NOT NULL, delta BIGINT, value DOUBLE PRECISION, created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+CREATE INDEX IF NOT EXISTS samples_id_created_at_idx ON samples (id, metric_type, created_at)
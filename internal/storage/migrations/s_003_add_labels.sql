@@ -0,0 +1,6 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS metrics_id_labels_idx ON metrics (id, labels);
+ALTER TABLE samples ADD COLUMN IF NOT EXISTS labels VARCHAR NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS samples_id_created_at_idx;
+CREATE INDEX IF NOT EXISTS samples_id_labels_created_at_idx ON samples (id, labels, metric_type, created_at)
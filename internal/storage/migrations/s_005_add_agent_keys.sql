@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS agent_keys (agent_id VARCHAR PRIMARY KEY, key VARCHAR NOT NULL, revoked BOOLEAN NOT NULL DEFAULT false)
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/config"
+	"github.com/AlekseyKas/metrics/internal/config/migrate"
+	"github.com/AlekseyKas/metrics/internal/retry"
+	"github.com/AlekseyKas/metrics/internal/server/database"
+	"github.com/AlekseyKas/metrics/internal/storage/migrations"
+)
+
+// Storage in memory backed by Postgres
+type PostgresStorage struct {
+	*MetricsStore
+	Ctx  context.Context
+	Conn *pgxpool.Pool
+	// retries of connection and writes
+	retry retry.Policy
+}
+
+// Create Postgres storage, migrate database and restore metrics from it
+func NewPostgresStorage(ctx context.Context, params config.Args) (*PostgresStorage, error) {
+	p := &PostgresStorage{
+		MetricsStore: NewMetricsStore(),
+		Ctx:          ctx,
+		retry:        retry.Default,
+	}
+	p.SetSeriesLimit(params.SeriesLimit)
+	// args without retries, like in tests, use default policy
+	if params.RetryAttempts != 0 {
+		var err error
+		p.retry, err = retry.NewPolicy(params.RetryAttempts, params.RetryBackoff)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := p.InitDB(params.DBURL)
+	if err != nil {
+		return nil, err
+	}
+	if params.Restore {
+		err = p.LoadMetricsDB()
+		if err != nil {
+			Logger.Error("Error load metrics to database LoadMetricsDB: ", zap.Error(err))
+		}
+	}
+	return p, nil
+}
+
+func (p *PostgresStorage) Ping() error {
+	err := p.Conn.Ping(p.Ctx)
+	if err != nil {
+		Logger.Error("Error checking connection to database: ", zap.Error(err))
+	}
+	return err
+}
+
+func (p *PostgresStorage) Close() error {
+	p.Conn.Close()
+	return nil
+}
+
+// Connect to database with retries of temporary errors and migrate it
+func (p *PostgresStorage) InitDB(DBURL string) error {
+	var err error
+	p.Conn, err = database.Connect(p.Ctx, Logger, DBURL, p.retry)
+	if err != nil {
+		Logger.Error("Error conncet to DB: ", zap.Error(err))
+		return err
+	}
+	err = migrate.MigrateFromFS(p.Ctx, p.Conn, &migrations.Migrations, Logger)
+	if err != nil {
+		Logger.Error("Error migration: ", zap.Error(err))
+		return err
+	}
+	return err
+}
+
+// Loading metrics from database
+func (p *PostgresStorage) LoadMetricsDB() error {
+	var id string
+	var labels string
+	var metricType string
+	var value *float64
+	var delta *int64
+	var buckets []byte
+	var sum *float64
+	var count *int64
+	row, err := p.Conn.Query(p.Ctx, "SELECT id, labels, metric_type, value, delta, buckets, sum, count FROM metrics")
+	if err != nil {
+		Logger.Error("Error select all from table metrics: ", zap.Error(err))
+		return err
+	}
+	defer row.Close()
+	for row.Next() {
+		err = row.Scan(&id, &labels, &metricType, &value, &delta, &buckets, &sum, &count)
+		if err != nil {
+			Logger.Error("Error scan row in select all: ", zap.Error(err))
+			continue
+		}
+		l, _ := ParseLabels(labels)
+		if metricType == "gauge" && value != nil {
+			p.reg.setGauge(MetricKey(id, l), *value, false)
+		}
+		if metricType == "counter" && delta != nil {
+			p.reg.setCounter(MetricKey(id, l), *delta)
+		}
+		if metricType == "histogram" && sum != nil && count != nil {
+			h := Histogram{Sum: *sum, Count: *count}
+			err = json.Unmarshal(buckets, &h.Buckets)
+			if err != nil {
+				Logger.Error("Error unmarshaling buckets of histogram: ", zap.Error(err))
+				continue
+			}
+			err = p.reg.setHistogram(MetricKey(id, l), h)
+			if err != nil {
+				Logger.Error("Error loading histogram from database: ", zap.Error(err))
+			}
+		}
+	}
+	return row.Err()
+}
+
+// Update gauge in memory and database
+func (p *PostgresStorage) UpdateGauge(nameMet string, value float64) error {
+	p.batch.Lock()
+	defer p.batch.Unlock()
+	err := p.MetricsStore.UpdateGauge(nameMet, value)
+	if err != nil {
+		return err
+	}
+	return p.changeMetricDB(nameMet, value, "gauge")
+}
+
+// Add delta to gauge in memory and store new value in database
+func (p *PostgresStorage) AddGauge(nameMet string, delta float64) (float64, error) {
+	p.batch.Lock()
+	defer p.batch.Unlock()
+	value, err := p.MetricsStore.AddGauge(nameMet, delta)
+	if err != nil {
+		return 0, err
+	}
+	return value, p.changeMetricDB(nameMet, value, "gauge")
+}
+
+// Add delta to counter in memory and store new value in database
+func (p *PostgresStorage) UpdateCounter(nameMet string, delta int64) (int64, error) {
+	p.batch.Lock()
+	defer p.batch.Unlock()
+	value, err := p.MetricsStore.UpdateCounter(nameMet, delta)
+	if err != nil {
+		return 0, err
+	}
+	return value, p.changeMetricDB(nameMet, value, "counter")
+}
+
+// Merge histogram in memory and store result in database
+func (p *PostgresStorage) UpdateHistogram(nameMet string, h Histogram) (Histogram, error) {
+	p.batch.Lock()
+	defer p.batch.Unlock()
+	merged, err := p.MetricsStore.UpdateHistogram(nameMet, h)
+	if err != nil {
+		return Histogram{}, err
+	}
+	return merged, p.changeMetricDB(nameMet, merged, "histogram")
+}
+
+// Update metrics in database
+func (p *PostgresStorage) changeMetricDB(nameMet string, value interface{}, typeMet string) error {
+	row := batchRow{key: nameMet, mType: typeMet}
+	switch v := value.(type) {
+	case float64:
+		row.value = v
+	case int64:
+		row.delta = v
+	case Histogram:
+		row.hist = v
+	}
+	return p.writeRows([]batchRow{row})
+}
+
+// Write values of metrics and their samples in one transaction, nothing is written on error.
+// Samples of every written metric are trimmed to limit of series like ring in memory
+func (p *PostgresStorage) writeRows(rows []batchRow) error {
+	b := &pgx.Batch{}
+	// series of metric, its samples are trimmed once per batch
+	type seriesKey struct{ key, mType string }
+	trimmed := make(map[seriesKey]bool)
+	for _, row := range rows {
+		id, l := ParseMetricKey(row.key)
+		labels := FormatLabels(l)
+		switch row.mType {
+		case "gauge":
+			b.Queue("INSERT INTO metrics (id, labels, metric_type, value) VALUES($1,$2,$3,$4) ON CONFLICT (id, labels) DO UPDATE SET value = $4", id, labels, row.mType, row.value)
+			b.Queue("INSERT INTO samples (id, labels, metric_type, value) VALUES($1,$2,$3,$4)", id, labels, row.mType, row.value)
+			trimmed[seriesKey{key: row.key, mType: row.mType}] = true
+		case "counter":
+			b.Queue("INSERT INTO metrics (id, labels, metric_type, delta) VALUES($1,$2,$3,$4) ON CONFLICT (id, labels) DO UPDATE SET delta = $4", id, labels, row.mType, row.delta)
+			b.Queue("INSERT INTO samples (id, labels, metric_type, delta) VALUES($1,$2,$3,$4)", id, labels, row.mType, row.delta)
+			trimmed[seriesKey{key: row.key, mType: row.mType}] = true
+		case "histogram":
+			buckets, err := json.Marshal(row.hist.Buckets)
+			if err != nil {
+				return err
+			}
+			b.Queue("INSERT INTO metrics (id, labels, metric_type, buckets, sum, count) VALUES($1,$2,$3,$4,$5,$6) ON CONFLICT (id, labels) DO UPDATE SET buckets = $4, sum = $5, count = $6", id, labels, row.mType, string(buckets), row.hist.Sum, row.hist.Count)
+		}
+	}
+	for k := range trimmed {
+		p.queueTrim(b, k.key, k.mType)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	// batch is written again in new transaction if previous one failed by temporary error
+	return p.retry.Do(p.Ctx, func() error {
+		return p.sendBatch(b)
+	})
+}
+
+// Queue removal of samples older than last limit samples of metric, samples written
+// in one transaction share timestamp, so all of them are kept
+func (p *PostgresStorage) queueTrim(b *pgx.Batch, key string, typeMet string) {
+	limit := p.reg.seriesLimit
+	if limit <= 0 {
+		limit = DefaultSeriesLimit
+	}
+	id, l := ParseMetricKey(key)
+	b.Queue(`DELETE FROM samples WHERE id = $1 AND labels = $2 AND metric_type = $3 AND created_at <
+		(SELECT created_at FROM samples WHERE id = $1 AND labels = $2 AND metric_type = $3 ORDER BY created_at DESC OFFSET $4 LIMIT 1)`,
+		id, FormatLabels(l), typeMet, limit-1)
+}
+
+// Send batch of statements in one transaction
+func (p *PostgresStorage) sendBatch(b *pgx.Batch) error {
+	tx, err := p.Conn.Begin(p.Ctx)
+	if err != nil {
+		Logger.Error("Error begin transaction: ", zap.Error(err))
+		return err
+	}
+	// rollback after commit does nothing
+	defer tx.Rollback(p.Ctx)
+	br := tx.SendBatch(p.Ctx, b)
+	for i := 0; i < b.Len(); i++ {
+		_, err = br.Exec()
+		if err != nil {
+			br.Close()
+			Logger.Error("Error write metrics in database: ", zap.Error(err))
+			return err
+		}
+	}
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(p.Ctx)
+	if err != nil {
+		Logger.Error("Error commit transaction: ", zap.Error(err))
+	}
+	return err
+}
+
+// Get history of metric from database
+func (p *PostgresStorage) GetSeries(nameMet string, typeMet string, from time.Time, to time.Time) ([]Sample, error) {
+	id, labels := ParseMetricKey(nameMet)
+	rows, err := p.Conn.Query(p.Ctx, "SELECT created_at, delta, value FROM samples WHERE id = $1 AND labels = $2 AND metric_type = $3 AND created_at BETWEEN $4 AND $5 ORDER BY created_at", id, FormatLabels(labels), typeMet, from, to)
+	if err != nil {
+		Logger.Error("Error select samples: ", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+	samples := []Sample{}
+	for rows.Next() {
+		var sample Sample
+		err = rows.Scan(&sample.Timestamp, &sample.Delta, &sample.Value)
+		if err != nil {
+			Logger.Error("Error scan row of samples: ", zap.Error(err))
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Count of shards in registry, every shard has own lock
+const shardCount = 32
+
+// Error of updating metric stored with another type
+var ErrTypeMismatch = errors.New("metric is stored with another type")
+
+// Value of metric with its type
+type metric struct {
+	mType string
+	value float64
+	delta int64
+	hist  Histogram
+	summ  *summaryStream
+}
+
+// Part of registry guarded by own lock
+type shard struct {
+	mux     sync.RWMutex
+	metrics map[string]metric
+	series  map[string]*series
+}
+
+// Typed concurrent registry of metrics sharded by key
+type registry struct {
+	shards      [shardCount]shard
+	seriesLimit int
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].metrics = make(map[string]metric)
+	}
+	return r
+}
+
+// Get shard of key
+func (r *registry) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &r.shards[h.Sum32()%shardCount]
+}
+
+// Set value of gauge
+func (r *registry) setGauge(key string, value float64, keepSample bool) error {
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if m, ok := s.metrics[key]; ok && m.mType != "gauge" {
+		return ErrTypeMismatch
+	}
+	s.metrics[key] = metric{mType: "gauge", value: value}
+	if keepSample {
+		s.addSample(key, "gauge", Sample{Timestamp: time.Now(), Value: &value}, r.seriesLimit)
+	}
+	return nil
+}
+
+// Add delta to gauge and return new value, missing gauge starts from zero
+func (r *registry) addGauge(key string, delta float64, keepSample bool) (float64, error) {
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m, ok := s.metrics[key]
+	if ok && m.mType != "gauge" {
+		return 0, ErrTypeMismatch
+	}
+	value := m.value + delta
+	s.metrics[key] = metric{mType: "gauge", value: value}
+	if keepSample {
+		s.addSample(key, "gauge", Sample{Timestamp: time.Now(), Value: &value}, r.seriesLimit)
+	}
+	return value, nil
+}
+
+// Add delta to counter and return new value
+func (r *registry) addCounter(key string, delta int64, keepSample bool) (int64, error) {
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m, ok := s.metrics[key]
+	if ok && m.mType != "counter" {
+		return 0, ErrTypeMismatch
+	}
+	m.mType = "counter"
+	m.delta += delta
+	s.metrics[key] = m
+	if keepSample {
+		value := m.delta
+		s.addSample(key, "counter", Sample{Timestamp: time.Now(), Delta: &value}, r.seriesLimit)
+	}
+	return m.delta, nil
+}
+
+// Set value of counter
+func (r *registry) setCounter(key string, value int64) {
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.metrics[key] = metric{mType: "counter", delta: value}
+}
+
+// Merge histogram with stored one and return result
+func (r *registry) addHistogram(key string, h Histogram) (Histogram, error) {
+	err := h.Validate()
+	if err != nil {
+		return Histogram{}, err
+	}
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m, ok := s.metrics[key]
+	if ok && m.mType != "histogram" {
+		return Histogram{}, ErrTypeMismatch
+	}
+	if ok {
+		h, err = m.hist.merge(h)
+		if err != nil {
+			return Histogram{}, err
+		}
+	} else {
+		h = h.clone()
+	}
+	s.metrics[key] = metric{mType: "histogram", hist: h}
+	return h.clone(), nil
+}
+
+// Set histogram
+func (r *registry) setHistogram(key string, h Histogram) error {
+	err := h.Validate()
+	if err != nil {
+		return err
+	}
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if m, ok := s.metrics[key]; ok && m.mType != "histogram" {
+		return ErrTypeMismatch
+	}
+	s.metrics[key] = metric{mType: "histogram", hist: h.clone()}
+	return nil
+}
+
+// Add observations to summary
+func (r *registry) observe(key string, values []float64) error {
+	s := r.shard(key)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m, ok := s.metrics[key]
+	if ok && m.mType != "summary" {
+		return ErrTypeMismatch
+	}
+	if !ok {
+		m = metric{mType: "summary", summ: newSummaryStream()}
+	}
+	for _, v := range values {
+		m.summ.observe(v)
+	}
+	s.metrics[key] = m
+	return nil
+}
+
+// Get metric by key
+func (r *registry) get(key string) (metric, bool) {
+	s := r.shard(key)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	m, ok := s.metrics[key]
+	m.hist = m.hist.clone()
+	m.summ = m.summ.clone()
+	return m, ok
+}
+
+// Call fn for every metric in registry
+func (r *registry) each(fn func(key string, m metric)) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mux.RLock()
+		for k, m := range s.metrics {
+			fn(k, m)
+		}
+		s.mux.RUnlock()
+	}
+}
+
+// Count of metrics in registry
+func (r *registry) len() int {
+	n := 0
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mux.RLock()
+		n += len(s.metrics)
+		s.mux.RUnlock()
+	}
+	return n
+}
+
+// Get history of metric in range [from, to]
+func (r *registry) between(key string, typeMet string, from time.Time, to time.Time) []Sample {
+	s := r.shard(key)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	ser, ok := s.series[key]
+	if !ok || ser.MType != typeMet {
+		return []Sample{}
+	}
+	return ser.between(from, to)
+}
+
+// Keep value of metric in history, must be called under lock
+func (s *shard) addSample(key string, typeMet string, sample Sample, limit int) {
+	if s.series == nil {
+		s.series = make(map[string]*series)
+	}
+	ser, ok := s.series[key]
+	if !ok || ser.MType != typeMet {
+		ser = newSeries(typeMet, limit)
+		s.series[key] = ser
+	}
+	ser.add(sample)
+}
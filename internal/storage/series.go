@@ -0,0 +1,54 @@
+package storage
+
+import "time"
+
+// Default count of samples kept in memory for every metric
+const DefaultSeriesLimit = 1000
+
+// Timestamped value of metric
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+}
+
+// Bounded ring of samples for one metric
+type series struct {
+	MType   string
+	samples []Sample
+	limit   int
+	next    int
+}
+
+func newSeries(mType string, limit int) *series {
+	if limit <= 0 {
+		limit = DefaultSeriesLimit
+	}
+	return &series{
+		MType: mType,
+		limit: limit,
+	}
+}
+
+// Add sample, the oldest one is overwritten when ring is full
+func (s *series) add(sample Sample) {
+	if len(s.samples) < s.limit {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % s.limit
+}
+
+// Samples in range [from, to] in order of adding
+func (s *series) between(from, to time.Time) []Sample {
+	ordered := append(s.samples[s.next:len(s.samples):len(s.samples)], s.samples[:s.next]...)
+	result := []Sample{}
+	for _, sample := range ordered {
+		if sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, sample)
+	}
+	return result
+}
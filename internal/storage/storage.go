@@ -3,25 +3,17 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
-	"os"
-	"reflect"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/shirou/gopsutil/v3/mem"
-	"github.com/sirupsen/logrus"
+	"github.com/fatih/structs"
 	"go.uber.org/zap"
 
 	"github.com/AlekseyKas/metrics/internal/config"
-	"github.com/AlekseyKas/metrics/internal/config/migrate"
-	"github.com/AlekseyKas/metrics/internal/server/database"
-	"github.com/AlekseyKas/metrics/internal/storage/migrations"
 )
 
 // Init type metrics gauge and counter
@@ -64,167 +56,194 @@ type Metrics struct {
 
 // Struct for metrics type JSON
 type JSONMetrics struct {
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	Delta        *int64            `json:"delta,omitempty"`        // значение метрики в случае передачи counter
+	Value        *float64          `json:"value,omitempty"`        // значение метрики в случае передачи gauge
+	Sum          *float64          `json:"sum,omitempty"`          // сумма наблюдений в случае передачи histogram или summary
+	Count        *int64            `json:"count,omitempty"`        // количество наблюдений в случае передачи histogram или summary
+	Labels       map[string]string `json:"labels,omitempty"`       // метки метрики, входят в её идентификатор
+	Buckets      []Bucket          `json:"buckets,omitempty"`      // корзины histogram с накопленным количеством наблюдений
+	Observations []float64         `json:"observations,omitempty"` // наблюдения в случае передачи summary
+	Quantiles    []Quantile        `json:"quantiles,omitempty"`    // оценки квантилей summary в ответе сервера
+	ID           string            `json:"id"`                     // имя метрики
+	MType        string            `json:"type"`                   // параметр, принимающий значение gauge, counter, histogram или summary
+	Hash         string            `json:"hash,omitempty"`         // значение хеш-функции
 }
 
 // Storage metrics in memory
 type MetricsStore struct {
-	Ctx       context.Context
-	MM        map[string]interface{}
-	Conn      *pgxpool.Pool
+	reg       *registry
 	mux       sync.Mutex
+	batch     sync.Mutex // serializes batches and writes of backends, so stored values follow order of memory
 	PollCount int
 }
 
+// Create storage with known metrics
+func NewMetricsStore() *MetricsStore {
+	m := &MetricsStore{
+		reg: newRegistry(),
+	}
+	for k, v := range structs.Map(Metrics{}) {
+		switch v := v.(type) {
+		case gauge:
+			m.reg.setGauge(k, float64(v), false)
+		case counter:
+			m.reg.setCounter(k, int64(v))
+		}
+	}
+	return m
+}
+
+// Set count of samples kept in memory for every metric
+func (m *MetricsStore) SetSeriesLimit(limit int) {
+	m.reg.seriesLimit = limit
+}
+
 // Interface with method for agent
 type StorageAgent interface {
 	GetMetrics() map[string]interface{}
 	ChangeMetrics(metrics runtime.MemStats) error
-	ChangeMetricsNew(metrics *mem.VirtualMemoryStat, cpu []float64) error
+	ChangeGauges(gauges map[string]float64) error
 	GetMetricsJSON() ([]JSONMetrics, error)
+	ResetCounters(sent []JSONMetrics) error
 }
 
-// Interface with method for server
+// Interface with method for server, implemented by every backend
 type Storage interface {
-	StopDB()
-	InitDB(DBURL string) error
-	CheckConnection() error
-	LoadMetricsDB() error
-	ChangeMetricDB(nameMet string, value interface{}, typeMet string, params config.Args) error
+	Ping() error
+	Close() error
 	GetMetrics() map[string]interface{}
-	ChangeMetric(nameMet string, value interface{}, params config.Args) error
+	UpdateGauge(nameMet string, value float64) error
+	AddGauge(nameMet string, delta float64) (float64, error)
+	UpdateCounter(nameMet string, delta int64) (int64, error)
+	UpdateHistogram(nameMet string, h Histogram) (Histogram, error)
+	GetGauge(nameMet string) (float64, bool)
+	GetCounter(nameMet string) (int64, bool)
+	GetHistogram(nameMet string) (Histogram, bool)
+	ObserveSummary(nameMet string, values []float64) error
+	GetSummary(nameMet string) (Summary, bool)
 	GetStructJSON() JSONMetrics
-	LoadMetricsFile(file []byte)
 	GetMetricsJSON() ([]JSONMetrics, error)
 	GetSliceStruct() []JSONMetrics
+	GetSeries(nameMet string, typeMet string, from time.Time, to time.Time) ([]Sample, error)
+	UpdateBatch(metrics []JSONMetrics) error
 }
 
-// Init logger.
-var Logger *zap.Logger
+// Error of checking connection to storage without database
+var ErrNoDatabase = errors.New("storage has no database")
 
-func InitLogger(logger *zap.Logger) {
-	Logger = logger
+// Create backend of storage selected by params
+func New(ctx context.Context, params config.Args) (Storage, error) {
+	kind := params.Storage
+	if kind == "" {
+		switch {
+		case params.DBURL != "":
+			kind = "postgres"
+		case params.StoreFile != "":
+			kind = "file"
+		default:
+			kind = "memory"
+		}
+	}
+	switch kind {
+	case "memory":
+		m := NewMetricsStore()
+		m.SetSeriesLimit(params.SeriesLimit)
+		return m, nil
+	case "file":
+		return NewFileStorage(ctx, params)
+	case "postgres":
+		return NewPostgresStorage(ctx, params)
+	}
+	return nil, fmt.Errorf("unknown storage %q", kind)
 }
 
-func (m *MetricsStore) CheckConnection() error {
-	err := m.Conn.Ping(m.Ctx)
-	if err != nil {
-		Logger.Error("Error checking connection to database: ", zap.Error(err))
+// Save metric of JSON format in storage by its type
+func SaveMetric(s Storage, m *JSONMetrics) error {
+	nameMet := MetricKey(m.ID, m.Labels)
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return ErrMissingValue
+		}
+		return s.UpdateGauge(nameMet, *m.Value)
+	case "counter":
+		if m.Delta == nil {
+			return ErrMissingValue
+		}
+		_, err := s.UpdateCounter(nameMet, *m.Delta)
+		return err
+	case "histogram":
+		h, ok := m.Histogram()
+		if !ok {
+			return ErrMissingValue
+		}
+		_, err := s.UpdateHistogram(nameMet, h)
+		return err
+	case "summary":
+		if len(m.Observations) == 0 {
+			return ErrMissingValue
+		}
+		return s.ObserveSummary(nameMet, m.Observations)
 	}
-	return err
+	return ErrUnknownType
 }
 
-func (m *MetricsStore) StopDB() {
-	m.Conn.Close()
+// Metric can not be saved because of its data
+func IsInvalidMetric(err error) bool {
+	return errors.Is(err, ErrTypeMismatch) ||
+		errors.Is(err, ErrBucketsMismatch) ||
+		errors.Is(err, ErrInvalidHistogram)
 }
 
-func (m *MetricsStore) InitDB(DBURL string) error {
-	var err error
-loop:
-	for {
-		select {
-		case <-m.Ctx.Done():
-			break loop
-		case <-time.After(2 * time.Second):
-			m.Conn, err = database.Connect(m.Ctx, Logger, DBURL)
-			if err != nil {
-				Logger.Error("Error conncet to DB: ", zap.Error(err))
-				continue
-			}
-			break loop
-		}
-	}
-	err = migrate.MigrateFromFS(m.Ctx, m.Conn, &migrations.Migrations, Logger)
-	if err != nil {
-		Logger.Error("Error migration: ", zap.Error(err))
-		return err
-	}
-	return err
+// Init logger.
+var Logger *zap.Logger
+
+func InitLogger(logger *zap.Logger) {
+	Logger = logger
 }
 
-// Loading metrics to database
-func (m *MetricsStore) LoadMetricsDB() error {
-	var id string
-	var metricType string
-	var value *float64
-	var delta *int64
-	row, err := m.Conn.Query(m.Ctx, "SELECT id, metric_type, value, delta FROM metrics")
-	if err != nil {
-		Logger.Error("Error select all from table metrics: ", zap.Error(err))
-	}
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	for row.Next() {
-		err = row.Scan(&id, &metricType, &value, &delta)
-		if err != nil {
-			Logger.Error("Error scan row in select all: ", zap.Error(err))
-		}
-		if metricType == "gauge" {
-			m.MM[id] = value
-		} else {
-			m.MM[id] = delta
-		}
-	}
-	return nil
+// Memory storage has no database
+func (m *MetricsStore) Ping() error {
+	return ErrNoDatabase
 }
 
-// Update metrics in database
-func (m *MetricsStore) ChangeMetricDB(nameMet string, value interface{}, typeMet string, params config.Args) error {
-	var err error
-	if params.DBURL != "" {
-		switch typeMet {
-		case "gauge":
-			_, err = m.Conn.Exec(m.Ctx, "INSERT INTO metrics (id, metric_type, value) VALUES($1,$2,$3) ON CONFLICT (id) DO UPDATE SET value = $3", nameMet, typeMet, value)
-			if err != nil {
-				Logger.Error("Error insert metric gauge in database: ", zap.Error(err))
-			}
-		case "counter":
-			_, err = m.Conn.Exec(m.Ctx, "INSERT INTO metrics (id, metric_type, delta) VALUES($1,$2,$3) ON CONFLICT (id) DO UPDATE SET delta = $3", nameMet, typeMet, value)
-			if err != nil {
-				logrus.Error("Error insert metric counter in database: ", zap.Error(err))
-			}
-		}
-	}
-	return err
+// Nothing to release for memory storage
+func (m *MetricsStore) Close() error {
+	return nil
 }
 
-// Load metrics from file
-func (m *MetricsStore) LoadMetricsFile(file []byte) {
-	m.mux.Lock()
-	defer m.mux.Unlock()
+// Load metrics from JSON format
+func (m *MetricsStore) loadMetricsJSON(file []byte) error {
 	var jMetric []JSONMetrics
 	err := json.Unmarshal(file, &jMetric)
 	if err != nil {
 		Logger.Error("Error unmarshaling file to map", zap.Error(err))
+		return err
 	}
 	for i := 0; i < len(jMetric); i++ {
-		if _, ok := m.MM[jMetric[i].ID]; ok {
-			for k := range m.MM {
-				if k == jMetric[i].ID {
-					if jMetric[i].Delta != nil {
-						v := jMetric[i].Delta
-						m.MM[k] = counter(*v)
-					}
-					if jMetric[i].Value != nil {
-						v := jMetric[i].Value
-						m.MM[k] = gauge(*v)
-					}
+		key := MetricKey(jMetric[i].ID, jMetric[i].Labels)
+		switch jMetric[i].MType {
+		case "counter":
+			if jMetric[i].Delta != nil {
+				m.reg.setCounter(key, *jMetric[i].Delta)
+			}
+		case "gauge":
+			if jMetric[i].Value != nil {
+				err = m.reg.setGauge(key, *jMetric[i].Value, false)
+				if err != nil {
+					Logger.Error("Error loading gauge from file: ", zap.Error(err))
 				}
 			}
-		} else {
-			ty := jMetric[i].MType
-			switch ty {
-			case "counter":
-				m.MM[jMetric[i].ID] = counter(*jMetric[i].Delta)
-			case "gauge":
-				m.MM[jMetric[i].ID] = gauge(*jMetric[i].Value)
+		case "histogram":
+			if h, ok := jMetric[i].Histogram(); ok {
+				err = m.reg.setHistogram(key, h)
+				if err != nil {
+					Logger.Error("Error loading histogram from file: ", zap.Error(err))
+				}
 			}
 		}
 	}
+	return nil
 }
 
 // Init JSON struct for metrics
@@ -241,127 +260,189 @@ func (m *MetricsStore) GetSliceStruct() []JSONMetrics {
 
 // Get metrics from memory format JSON
 func (m *MetricsStore) GetMetricsJSON() ([]JSONMetrics, error) {
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	var j []JSONMetrics
-	var err error
-	for k, v := range m.MM {
-		if strings.Split(reflect.ValueOf(v).Type().String(), ".")[1] == "gauge" {
-			var a float64
-			a, err = strconv.ParseFloat(fmt.Sprintf("%v", v), 64)
-			if err != nil {
-				Logger.Error("Error parsing gauge value: ", zap.Error(err))
-			}
-			j = append(j, JSONMetrics{
-				ID:    k,
-				MType: strings.Split(reflect.ValueOf(v).Type().String(), ".")[1],
-				Value: &a,
-			})
+	j := make([]JSONMetrics, 0, m.reg.len())
+	m.reg.each(func(k string, v metric) {
+		id, labels := ParseMetricKey(k)
+		jm := JSONMetrics{
+			ID:     id,
+			MType:  v.mType,
+			Labels: labels,
 		}
-		if strings.Split(reflect.ValueOf(v).Type().String(), ".")[1] == "counter" {
-			var i int64
-			i, err = strconv.ParseInt(fmt.Sprintf("%v", v), 10, 64)
-			if err != nil {
-				Logger.Error("Error parsing counter value: ", zap.Error(err))
-			}
-			j = append(j, JSONMetrics{
-				ID:    k,
-				MType: strings.Split(reflect.ValueOf(v).Type().String(), ".")[1],
-				Delta: &i,
-			})
+		switch v.mType {
+		case "gauge":
+			value := v.value
+			jm.Value = &value
+		case "counter":
+			delta := v.delta
+			jm.Delta = &delta
+		case "histogram":
+			jm.SetHistogram(v.hist)
+		case "summary":
+			jm.SetSummary(v.summ.summary())
 		}
-	}
-	return j, err
+		j = append(j, jm)
+	})
+	return j, nil
 }
 
 // Update metrics always
 func (m *MetricsStore) ChangeMetrics(memStats runtime.MemStats) error {
 	m.mux.Lock()
-	defer m.mux.Unlock()
-	m.PollCount++
-	m.MM["BuckHashSys"] = gauge(memStats.BuckHashSys)
-	m.MM["Frees"] = gauge(memStats.Frees)
-	m.MM["GCCPUFraction"] = gauge(memStats.GCCPUFraction)
-	m.MM["GCSys"] = gauge(memStats.GCSys)
-	m.MM["HeapAlloc"] = gauge(memStats.HeapAlloc)
-	m.MM["Alloc"] = gauge((memStats.Alloc))
-	m.MM["HeapIdle"] = gauge(memStats.HeapIdle)
-	m.MM["HeapInuse"] = gauge(memStats.HeapInuse)
-	m.MM["HeapObjects"] = gauge(memStats.HeapObjects)
-	m.MM["HeapReleased"] = gauge(memStats.HeapReleased)
-	m.MM["HeapSys"] = gauge(memStats.HeapSys)
-	m.MM["LastGC"] = gauge(memStats.LastGC)
-	m.MM["Lookups"] = gauge(memStats.Lookups)
-	m.MM["MCacheInuse"] = gauge(memStats.MCacheInuse)
-	m.MM["MCacheSys"] = gauge(memStats.MCacheSys)
-	m.MM["MSpanInuse"] = gauge(memStats.MSpanInuse)
-	m.MM["MSpanSys"] = gauge(memStats.MSpanSys)
-	m.MM["Mallocs"] = gauge(memStats.Mallocs)
-	m.MM["NextGC"] = gauge(memStats.NextGC)
-	m.MM["NumForcedGC"] = gauge(memStats.NumForcedGC)
-	m.MM["NumGC"] = gauge(memStats.NumGC)
-	m.MM["OtherSys"] = gauge(memStats.OtherSys)
-	m.MM["PauseTotalNs"] = gauge(memStats.PauseTotalNs)
-	m.MM["StackInuse"] = gauge(memStats.StackInuse)
-	m.MM["StackSys"] = gauge(memStats.StackSys)
-	m.MM["Sys"] = gauge(memStats.Sys)
-	m.MM["TotalAlloc"] = gauge(memStats.TotalAlloc)
-	m.MM["RandomValue"] = gauge(rand.Float64())
-	m.MM["PollCount"] = counter(m.PollCount)
+	pollCount, err := m.reg.addCounter("PollCount", 1, false)
+	m.PollCount = int(pollCount)
+	m.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	gauges := map[string]float64{
+		"BuckHashSys":   float64(memStats.BuckHashSys),
+		"Frees":         float64(memStats.Frees),
+		"GCCPUFraction": memStats.GCCPUFraction,
+		"GCSys":         float64(memStats.GCSys),
+		"HeapAlloc":     float64(memStats.HeapAlloc),
+		"Alloc":         float64(memStats.Alloc),
+		"HeapIdle":      float64(memStats.HeapIdle),
+		"HeapInuse":     float64(memStats.HeapInuse),
+		"HeapObjects":   float64(memStats.HeapObjects),
+		"HeapReleased":  float64(memStats.HeapReleased),
+		"HeapSys":       float64(memStats.HeapSys),
+		"LastGC":        float64(memStats.LastGC),
+		"Lookups":       float64(memStats.Lookups),
+		"MCacheInuse":   float64(memStats.MCacheInuse),
+		"MCacheSys":     float64(memStats.MCacheSys),
+		"MSpanInuse":    float64(memStats.MSpanInuse),
+		"MSpanSys":      float64(memStats.MSpanSys),
+		"Mallocs":       float64(memStats.Mallocs),
+		"NextGC":        float64(memStats.NextGC),
+		"NumForcedGC":   float64(memStats.NumForcedGC),
+		"NumGC":         float64(memStats.NumGC),
+		"OtherSys":      float64(memStats.OtherSys),
+		"PauseTotalNs":  float64(memStats.PauseTotalNs),
+		"StackInuse":    float64(memStats.StackInuse),
+		"StackSys":      float64(memStats.StackSys),
+		"Sys":           float64(memStats.Sys),
+		"TotalAlloc":    float64(memStats.TotalAlloc),
+		"RandomValue":   rand.Float64(),
+	}
+	for k, v := range gauges {
+		err := m.reg.setGauge(k, v, false)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Change metrics TotalMemory, FreeMemory, CPUutilization1
-func (m *MetricsStore) ChangeMetricsNew(mem *mem.VirtualMemoryStat, cpu []float64) error {
+// Subtract counters sent to server, increments made while sending are kept for next report
+func (m *MetricsStore) ResetCounters(sent []JSONMetrics) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	m.MM["TotalMemory"] = gauge(float64(mem.Total))
-	m.MM["FreeMemory"] = gauge(float64(mem.Free))
-	m.MM["CPUutilization1"] = gauge(cpu[0])
+	for _, s := range sent {
+		if s.MType != "counter" || s.Delta == nil {
+			continue
+		}
+		delta, err := m.reg.addCounter(s.ID, -*s.Delta, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.ID, err)
+		}
+		if s.ID == "PollCount" {
+			m.PollCount = int(delta)
+		}
+	}
 	return nil
 }
 
-// Change all metrics
-func (m *MetricsStore) ChangeMetric(nameMet string, value interface{}, params config.Args) error {
-	sl, err := m.GetMetricsJSON()
-	if err != nil {
-		logrus.Error("Error getting metric JSON formay: ", err)
-	}
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	if params.StoreInterval == 0 {
-		m.MM[nameMet] = value
-		// Change
-		if params.StoreFile != "" {
-			var file *os.File
-			file, err = os.OpenFile(params.StoreFile, os.O_WRONLY|os.O_TRUNC, 0777)
-			if err != nil {
-				Logger.Error("Error open file for writing:!!!!!!!! ", zap.Error(err))
-			}
-			defer file.Close()
-			var data []byte
-			data, err = json.Marshal(sl)
-			if err != nil {
-				Logger.Error("Error marshaling metrics : ", zap.Error(err))
-			}
-			_, err = file.Write(data)
-			if err != nil {
-				Logger.Error("Error write metrics to file : ", zap.Error(err))
-			}
+// Change gauges collected by agent from system
+func (m *MetricsStore) ChangeGauges(gauges map[string]float64) error {
+	for k, v := range gauges {
+		err := m.reg.setGauge(k, v, false)
+		if err != nil {
+			return err
 		}
-	} else {
-		m.MM[nameMet] = value
 	}
-	return err
+	return nil
+}
+
+// Update gauge
+func (m *MetricsStore) UpdateGauge(nameMet string, value float64) error {
+	return m.reg.setGauge(nameMet, value, true)
+}
+
+// Add delta to gauge atomically and return new value
+func (m *MetricsStore) AddGauge(nameMet string, delta float64) (float64, error) {
+	return m.reg.addGauge(nameMet, delta, true)
+}
+
+// Add delta to counter
+func (m *MetricsStore) UpdateCounter(nameMet string, delta int64) (int64, error) {
+	return m.reg.addCounter(nameMet, delta, true)
+}
+
+// Merge histogram with stored one
+func (m *MetricsStore) UpdateHistogram(nameMet string, h Histogram) (Histogram, error) {
+	return m.reg.addHistogram(nameMet, h)
+}
+
+// Add observations to summary, summaries are kept in memory only
+func (m *MetricsStore) ObserveSummary(nameMet string, values []float64) error {
+	return m.reg.observe(nameMet, values)
+}
+
+// Get value of gauge
+func (m *MetricsStore) GetGauge(nameMet string) (float64, bool) {
+	v, ok := m.reg.get(nameMet)
+	if !ok || v.mType != "gauge" {
+		return 0, false
+	}
+	return v.value, true
+}
+
+// Get value of counter
+func (m *MetricsStore) GetCounter(nameMet string) (int64, bool) {
+	v, ok := m.reg.get(nameMet)
+	if !ok || v.mType != "counter" {
+		return 0, false
+	}
+	return v.delta, true
+}
+
+// Get histogram
+func (m *MetricsStore) GetHistogram(nameMet string) (Histogram, bool) {
+	v, ok := m.reg.get(nameMet)
+	if !ok || v.mType != "histogram" {
+		return Histogram{}, false
+	}
+	return v.hist, true
+}
+
+// Get estimated quantiles of summary
+func (m *MetricsStore) GetSummary(nameMet string) (Summary, bool) {
+	v, ok := m.reg.get(nameMet)
+	if !ok || v.mType != "summary" {
+		return Summary{}, false
+	}
+	return v.summ.summary(), true
 }
 
 // Get all metrics from memory
 func (m *MetricsStore) GetMetrics() map[string]interface{} {
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	values := make(map[string]interface{}, (len(m.MM)))
-	for k, v := range m.MM {
-		values[k] = v
-	}
+	values := make(map[string]interface{}, m.reg.len())
+	m.reg.each(func(k string, v metric) {
+		switch v.mType {
+		case "gauge":
+			values[k] = v.value
+		case "counter":
+			values[k] = v.delta
+		case "histogram":
+			values[k] = v.hist
+		case "summary":
+			values[k] = v.summ.summary()
+		}
+	})
 	return values
 }
+
+// Get history of metric in range [from, to]
+func (m *MetricsStore) GetSeries(nameMet string, typeMet string, from time.Time, to time.Time) ([]Sample, error) {
+	return m.reg.between(nameMet, typeMet, from, to), nil
+}
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/AlekseyKas/metrics/internal/config"
+)
+
+// Conformance suite every backend of storage must pass
+func testStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Storage)
+	}{
+		{
+			name: "known metrics",
+			run: func(t *testing.T, s Storage) {
+				_, ok := s.GetGauge("Alloc")
+				require.True(t, ok)
+				_, ok = s.GetCounter("PollCount")
+				require.True(t, ok)
+				_, ok = s.GetGauge("unknown")
+				require.False(t, ok)
+			},
+		},
+		{
+			name: "gauge",
+			run: func(t *testing.T, s Storage) {
+				require.NoError(t, s.UpdateGauge("Alloc", 1.5))
+				require.NoError(t, s.UpdateGauge("Alloc", 2.5))
+				v, ok := s.GetGauge("Alloc")
+				require.True(t, ok)
+				require.Equal(t, 2.5, v)
+			},
+		},
+		{
+			name: "counter",
+			run: func(t *testing.T, s Storage) {
+				v, err := s.UpdateCounter("Hits", 2)
+				require.NoError(t, err)
+				require.Equal(t, int64(2), v)
+				v, err = s.UpdateCounter("Hits", 3)
+				require.NoError(t, err)
+				require.Equal(t, int64(5), v)
+				v, ok := s.GetCounter("Hits")
+				require.True(t, ok)
+				require.Equal(t, int64(5), v)
+			},
+		},
+		{
+			name: "type mismatch",
+			run: func(t *testing.T, s Storage) {
+				_, err := s.UpdateCounter("Alloc", 1)
+				require.ErrorIs(t, err, ErrTypeMismatch)
+				require.ErrorIs(t, s.UpdateGauge("PollCount", 1), ErrTypeMismatch)
+			},
+		},
+		{
+			name: "labels",
+			run: func(t *testing.T, s Storage) {
+				a := MetricKey("Alloc", map[string]string{"host": "a"})
+				b := MetricKey("Alloc", map[string]string{"host": "b"})
+				require.NoError(t, s.UpdateGauge(a, 1))
+				require.NoError(t, s.UpdateGauge(b, 2))
+				v, _ := s.GetGauge(a)
+				require.Equal(t, float64(1), v)
+				v, _ = s.GetGauge(b)
+				require.Equal(t, float64(2), v)
+
+				metrics, err := s.GetMetricsJSON()
+				require.NoError(t, err)
+				var found bool
+				for _, m := range metrics {
+					if m.ID == "Alloc" && m.Labels["host"] == "b" {
+						found = true
+						require.Equal(t, "gauge", m.MType)
+						require.Equal(t, float64(2), *m.Value)
+					}
+				}
+				require.True(t, found)
+				require.Contains(t, s.GetMetrics(), b)
+			},
+		},
+		{
+			name: "histogram",
+			run: func(t *testing.T, s Storage) {
+				h := Histogram{
+					Buckets: []Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 3}},
+					Sum:     1.7,
+					Count:   4,
+				}
+				_, err := s.UpdateHistogram("Latency", h)
+				require.NoError(t, err)
+				merged, err := s.UpdateHistogram("Latency", h)
+				require.NoError(t, err)
+				require.Equal(t, int64(8), merged.Count)
+				require.Equal(t, int64(6), merged.Buckets[1].Count)
+				v, ok := s.GetHistogram("Latency")
+				require.True(t, ok)
+				require.Equal(t, merged, v)
+
+				_, err = s.UpdateHistogram("Latency", Histogram{Buckets: []Bucket{{UpperBound: 5, Count: 1}}, Count: 1})
+				require.ErrorIs(t, err, ErrBucketsMismatch)
+				_, err = s.UpdateHistogram("Latency", Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 2}, {UpperBound: 0.1, Count: 3}}, Count: 3})
+				require.ErrorIs(t, err, ErrInvalidHistogram)
+				_, err = s.UpdateHistogram("Alloc", h)
+				require.ErrorIs(t, err, ErrTypeMismatch)
+			},
+		},
+		{
+			name: "summary",
+			run: func(t *testing.T, s Storage) {
+				require.NoError(t, s.ObserveSummary("Duration", []float64{3, 1, 2}))
+				require.NoError(t, s.ObserveSummary("Duration", []float64{4}))
+				v, ok := s.GetSummary("Duration")
+				require.True(t, ok)
+				require.Equal(t, int64(4), v.Count)
+				require.Equal(t, float64(10), v.Sum)
+				require.Len(t, v.Quantiles, len(SummaryQuantiles))
+				require.Equal(t, Quantile{Quantile: 0.99, Value: 4}, v.Quantiles[2])
+				require.ErrorIs(t, s.ObserveSummary("Alloc", []float64{1}), ErrTypeMismatch)
+				_, ok = s.GetHistogram("Duration")
+				require.False(t, ok)
+			},
+		},
+		{
+			name: "batch",
+			run: func(t *testing.T, s Storage) {
+				value := 1.5
+				delta := int64(2)
+				h := Histogram{Buckets: []Bucket{{UpperBound: 0.1, Count: 1}}, Sum: 0.05, Count: 1}
+				batch := []JSONMetrics{
+					{ID: "BatchGauge", MType: "gauge", Value: &value},
+					{ID: "BatchCounter", MType: "counter", Delta: &delta},
+					{ID: "BatchCounter", MType: "counter", Delta: &delta},
+					{ID: "BatchLatency", MType: "histogram", Buckets: h.Buckets, Sum: &h.Sum, Count: &h.Count},
+					{ID: "BatchDuration", MType: "summary", Observations: []float64{1, 2}},
+				}
+				require.NoError(t, s.UpdateBatch(batch))
+				c, _ := s.GetCounter("BatchCounter")
+				require.Equal(t, int64(4), c)
+				latency, _ := s.GetHistogram("BatchLatency")
+				require.Equal(t, int64(1), latency.Count)
+				duration, _ := s.GetSummary("BatchDuration")
+				require.Equal(t, int64(2), duration.Count)
+
+				// invalid metric at the end rejects whole batch
+				other := 7.5
+				tests := []struct {
+					name    string
+					invalid JSONMetrics
+					wantErr error
+				}{
+					{name: "type mismatch", invalid: JSONMetrics{ID: "BatchGauge", MType: "counter", Delta: &delta}, wantErr: ErrTypeMismatch},
+					{name: "missing value", invalid: JSONMetrics{ID: "BatchNew", MType: "gauge"}, wantErr: ErrMissingValue},
+					{name: "unknown type", invalid: JSONMetrics{ID: "BatchNew", MType: "set"}, wantErr: ErrUnknownType},
+					{name: "buckets mismatch", invalid: JSONMetrics{ID: "BatchLatency", MType: "histogram", Buckets: []Bucket{{UpperBound: 1, Count: 1}}, Sum: &h.Sum, Count: &h.Count}, wantErr: ErrBucketsMismatch},
+				}
+				for _, tt := range tests {
+					err := s.UpdateBatch([]JSONMetrics{
+						{ID: "BatchGauge", MType: "gauge", Value: &other},
+						{ID: "BatchCounter", MType: "counter", Delta: &delta},
+						tt.invalid,
+					})
+					require.ErrorIs(t, err, tt.wantErr, tt.name)
+					g, _ := s.GetGauge("BatchGauge")
+					require.Equal(t, value, g, tt.name)
+					c, _ := s.GetCounter("BatchCounter")
+					require.Equal(t, int64(4), c, tt.name)
+				}
+			},
+		},
+		{
+			name: "concurrent batches",
+			run: func(t *testing.T, s Storage) {
+				delta := int64(1)
+				wg := &sync.WaitGroup{}
+				for i := 0; i < 20; i++ {
+					wg.Add(2)
+					go func() {
+						defer wg.Done()
+						require.NoError(t, s.UpdateBatch([]JSONMetrics{{ID: "ConcurrentCounter", MType: "counter", Delta: &delta}}))
+					}()
+					go func() {
+						defer wg.Done()
+						_, err := s.UpdateCounter("ConcurrentCounter", delta)
+						require.NoError(t, err)
+					}()
+				}
+				wg.Wait()
+				c, _ := s.GetCounter("ConcurrentCounter")
+				require.Equal(t, int64(40), c)
+			},
+		},
+		{
+			name: "concurrent gauge additions",
+			run: func(t *testing.T, s Storage) {
+				wg := &sync.WaitGroup{}
+				for i := 0; i < 20; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := s.AddGauge("ConcurrentGauge", 0.5)
+						require.NoError(t, err)
+					}()
+				}
+				wg.Wait()
+				v, _ := s.GetGauge("ConcurrentGauge")
+				require.Equal(t, float64(10), v)
+				_, err := s.AddGauge("PollCount", 1)
+				require.ErrorIs(t, err, ErrTypeMismatch)
+			},
+		},
+		{
+			name: "series",
+			run: func(t *testing.T, s Storage) {
+				from := time.Now().Add(-time.Second)
+				require.NoError(t, s.UpdateGauge("Alloc", 1))
+				require.NoError(t, s.UpdateGauge("Alloc", 2))
+				samples, err := s.GetSeries("Alloc", "gauge", from, time.Now().Add(time.Second))
+				require.NoError(t, err)
+				require.Len(t, samples, 2)
+				require.Equal(t, float64(2), *samples[1].Value)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage(t)
+			defer s.Close()
+			tt.run(t, s)
+		})
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	InitLogger(zap.NewNop())
+	testStorage(t, func(t *testing.T) Storage {
+		s, err := New(context.Background(), config.Args{})
+		require.NoError(t, err)
+		require.IsType(t, &MetricsStore{}, s)
+		return s
+	})
+}
+
+func TestFileStorage(t *testing.T) {
+	InitLogger(zap.NewNop())
+	testStorage(t, func(t *testing.T) Storage {
+		s, err := New(context.Background(), config.Args{
+			StoreFile: filepath.Join(t.TempDir(), "metrics.json"),
+			Restore:   true,
+		})
+		require.NoError(t, err)
+		require.IsType(t, &FileStorage{}, s)
+		return s
+	})
+}
+
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	InitLogger(zap.NewNop())
+	testStorage(t, func(t *testing.T) Storage {
+		s, err := New(context.Background(), config.Args{DBURL: dsn})
+		require.NoError(t, err)
+		require.IsType(t, &PostgresStorage{}, s)
+		return s
+	})
+}
+
+func TestPostgresSeriesLimit(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	InitLogger(zap.NewNop())
+	p, err := NewPostgresStorage(context.Background(), config.Args{DBURL: dsn, SeriesLimit: 2})
+	require.NoError(t, err)
+	defer p.Close()
+	id := fmt.Sprintf("Retention%d", time.Now().UnixNano())
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, p.UpdateGauge(id, float64(i)))
+	}
+	// database keeps last samples like ring in memory
+	var count int
+	require.NoError(t, p.Conn.QueryRow(context.Background(), "SELECT count(*) FROM samples WHERE id = $1", id).Scan(&count))
+	require.Equal(t, 2, count)
+}
+
+func TestNewUnknownStorage(t *testing.T) {
+	_, err := New(context.Background(), config.Args{Storage: "redis"})
+	require.Error(t, err)
+}
+
+func TestFileStorageRestore(t *testing.T) {
+	InitLogger(zap.NewNop())
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		restore   bool
+		wantValue bool
+	}{
+		{name: "sync store", restore: true, wantValue: true},
+		{name: "sync store without restore", restore: false, wantValue: false},
+		{name: "store by interval", interval: time.Millisecond * 10, restore: true, wantValue: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			params := config.Args{
+				StoreFile:     filepath.Join(t.TempDir(), "metrics.json"),
+				StoreInterval: tt.interval,
+				Restore:       tt.restore,
+			}
+			s, err := NewFileStorage(ctx, params)
+			require.NoError(t, err)
+			_, err = s.UpdateCounter(MetricKey("Hits", map[string]string{"host": "a"}), 7)
+			require.NoError(t, err)
+			_, err = s.UpdateHistogram("Latency", Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 2}}, Sum: 0.5, Count: 2})
+			require.NoError(t, err)
+			if tt.interval > 0 {
+				require.Eventually(t, func() bool {
+					data, err := os.ReadFile(params.StoreFile)
+					return err == nil && strings.Contains(string(data), "Latency")
+				}, time.Second, tt.interval)
+			}
+
+			restored, err := NewFileStorage(ctx, params)
+			require.NoError(t, err)
+			v, ok := restored.GetCounter(MetricKey("Hits", map[string]string{"host": "a"}))
+			require.Equal(t, tt.wantValue, ok)
+			if tt.wantValue {
+				require.Equal(t, int64(7), v)
+			}
+			h, ok := restored.GetHistogram("Latency")
+			require.Equal(t, tt.wantValue, ok)
+			if tt.wantValue {
+				require.Equal(t, int64(2), h.Count)
+			}
+		})
+	}
+}
+
+func TestSummaryQuantiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		values func(i int) float64
+		n      int
+		want   []float64
+	}{
+		{name: "uniform", n: 10000, values: func(i int) float64 { return float64(i * 7919 % 10000) }, want: []float64{5000, 9000, 9900}},
+		{name: "constant", n: 100, values: func(i int) float64 { return 42 }, want: []float64{42, 42, 42}},
+		{name: "few observations", n: 3, values: func(i int) float64 { return float64(i) }, want: []float64{1, 2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSummaryStream()
+			for i := 0; i < tt.n; i++ {
+				s.observe(tt.values(i))
+			}
+			sum := s.summary()
+			require.Equal(t, int64(tt.n), sum.Count)
+			for i, q := range sum.Quantiles {
+				require.Equal(t, SummaryQuantiles[i], q.Quantile)
+				require.InDelta(t, tt.want[i], q.Value, float64(tt.n)*0.01)
+			}
+		})
+	}
+}
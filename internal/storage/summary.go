@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"sort"
+)
+
+// Quantiles estimated for every summary
+var SummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Estimated value of quantile
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Summary of observations with estimated quantiles
+type Summary struct {
+	Quantiles []Quantile `json:"quantiles"`
+	Sum       float64    `json:"sum"`
+	Count     int64      `json:"count"`
+}
+
+// Streaming estimation of quantiles of summary
+type summaryStream struct {
+	estimators []p2Quantile
+	sum        float64
+	count      int64
+}
+
+func newSummaryStream() *summaryStream {
+	s := &summaryStream{estimators: make([]p2Quantile, len(SummaryQuantiles))}
+	for i, q := range SummaryQuantiles {
+		s.estimators[i] = newP2Quantile(q)
+	}
+	return s
+}
+
+// Add observation to summary
+func (s *summaryStream) observe(v float64) {
+	s.sum += v
+	s.count++
+	for i := range s.estimators {
+		s.estimators[i].observe(v)
+	}
+}
+
+// Current estimation of summary
+func (s *summaryStream) summary() Summary {
+	sum := Summary{
+		Quantiles: make([]Quantile, len(s.estimators)),
+		Sum:       s.sum,
+		Count:     s.count,
+	}
+	for i := range s.estimators {
+		sum.Quantiles[i] = Quantile{Quantile: s.estimators[i].p, Value: s.estimators[i].value()}
+	}
+	return sum
+}
+
+// Copy of stream not sharing estimators
+func (s *summaryStream) clone() *summaryStream {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.estimators = append([]p2Quantile(nil), s.estimators...)
+	return &c
+}
+
+// Estimator of one quantile by P² algorithm, uses constant memory
+type p2Quantile struct {
+	p     float64
+	count int
+	// heights of markers
+	q [5]float64
+	// actual and desired positions of markers
+	n  [5]float64
+	np [5]float64
+	dn [5]float64
+}
+
+func newP2Quantile(p float64) p2Quantile {
+	return p2Quantile{
+		p:  p,
+		n:  [5]float64{0, 1, 2, 3, 4},
+		np: [5]float64{0, 2 * p, 4 * p, 2 + 2*p, 4},
+		dn: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+// Add observation to estimator
+func (e *p2Quantile) observe(x float64) {
+	if e.count < 5 {
+		e.q[e.count] = x
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.q[:])
+		}
+		return
+	}
+	e.count++
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+		k = 0
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3 && x >= e.q[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.n[i]++
+	}
+	for i := range e.np {
+		e.np[i] += e.dn[i]
+	}
+	for i := 1; i < 4; i++ {
+		d := e.np[i] - e.n[i]
+		if (d >= 1 && e.n[i+1]-e.n[i] > 1) || (d <= -1 && e.n[i-1]-e.n[i] < -1) {
+			if d > 0 {
+				d = 1
+			} else {
+				d = -1
+			}
+			q := e.parabolic(i, d)
+			if e.q[i-1] < q && q < e.q[i+1] {
+				e.q[i] = q
+			} else {
+				e.q[i] = e.linear(i, d)
+			}
+			e.n[i] += d
+		}
+	}
+}
+
+// Parabolic prediction of marker height
+func (e *p2Quantile) parabolic(i int, d float64) float64 {
+	return e.q[i] + d/(e.n[i+1]-e.n[i-1])*
+		((e.n[i]-e.n[i-1]+d)*(e.q[i+1]-e.q[i])/(e.n[i+1]-e.n[i])+
+			(e.n[i+1]-e.n[i]-d)*(e.q[i]-e.q[i-1])/(e.n[i]-e.n[i-1]))
+}
+
+// Linear prediction of marker height
+func (e *p2Quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.q[i] + d*(e.q[j]-e.q[i])/(e.n[j]-e.n[i])
+}
+
+// Estimated value of quantile, exact until markers start to move
+func (e *p2Quantile) value() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count <= 5 {
+		q := append([]float64(nil), e.q[:e.count]...)
+		sort.Float64s(q)
+		return q[int(e.p*float64(e.count-1)+0.5)]
+	}
+	return e.q[2]
+}
+
+// Set fields of summary in metric of JSON format
+func (j *JSONMetrics) SetSummary(s Summary) {
+	sum := s.Sum
+	count := s.Count
+	j.Quantiles = append([]Quantile(nil), s.Quantiles...)
+	j.Sum = &sum
+	j.Count = &count
+}